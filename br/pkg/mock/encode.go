@@ -68,6 +68,21 @@ func (mr *MockEncoderMockRecorder) Encode(arg0, arg1, arg2, arg3 any) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Encode", reflect.TypeOf((*MockEncoder)(nil).Encode), arg0, arg1, arg2, arg3)
 }
 
+// EncodeBatch mocks base method.
+func (m *MockEncoder) EncodeBatch(arg0 [][]types.Datum, arg1 int64, arg2 []int, arg3 []int64) ([]encode.Row, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EncodeBatch", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]encode.Row)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EncodeBatch indicates an expected call of EncodeBatch.
+func (mr *MockEncoderMockRecorder) EncodeBatch(arg0, arg1, arg2, arg3 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncodeBatch", reflect.TypeOf((*MockEncoder)(nil).EncodeBatch), arg0, arg1, arg2, arg3)
+}
+
 // MockEncodingBuilder is a mock of EncodingBuilder interface.
 type MockEncodingBuilder struct {
 	ctrl     *gomock.Controller
@@ -653,6 +653,14 @@ func (mockEncoder) Encode(row []types.Datum, rowID int64, columnPermutation []in
 	return &kv.Pairs{}, nil
 }
 
+func (mockEncoder) EncodeBatch(rows [][]types.Datum, firstRowID int64, columnPermutation []int, offsets []int64) ([]encode.Row, error) {
+	result := make([]encode.Row, 0, len(rows))
+	for range rows {
+		result = append(result, &kv.Pairs{})
+	}
+	return result, nil
+}
+
 func (mockEncoder) Close() {}
 
 func (s *chunkRestoreSuite) TestRestore() {
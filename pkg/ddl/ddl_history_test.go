@@ -20,6 +20,9 @@ package ddl_test
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"strconv"
 	"testing"
 
 	"github.com/ngaut/pools"
@@ -97,3 +100,92 @@ func TestDDLHistoryBasic(t *testing.T) {
 
 	require.NoError(t, err)
 }
+
+// checkLastJobDeleteRangeCnt checks the last DDL job has exactly the expected
+// number of delete ranges.
+func checkLastJobDeleteRangeCnt(t *testing.T, tk *testkit.TestKit, expected int) {
+	jobID, err := strconv.ParseInt(tk.MustQuery("admin show ddl jobs 1").Rows()[0][0].(string), 10, 64)
+	require.NoError(t, err)
+	report, err := ddl.ReconcileDeleteRangeCnt(tk.Session().GetStore(), tk.Session().GetSQLExecutor(), jobID)
+	require.NoError(t, err)
+	require.NoError(t, report.Err)
+	require.Equal(t, expected, report.Expected)
+	require.Equal(t, expected, report.Actual)
+}
+
+func TestReconcileDeleteRangeCnt(t *testing.T) {
+	store := testkit.CreateMockStore(t)
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec("use test")
+	tk.MustExec("create table t (a int, b int, key idx_b(b)) partition by hash (a) partitions 3")
+	tk.MustExec("alter table t drop index idx_b")
+	jobID, err := strconv.ParseInt(tk.MustQuery("admin show ddl jobs 1").Rows()[0][0].(string), 10, 64)
+	require.NoError(t, err)
+
+	report, err := ddl.ReconcileDeleteRangeCnt(store, tk.Session().GetSQLExecutor(), jobID)
+	require.NoError(t, err)
+	require.Equal(t, model.ActionDropIndex, report.JobType)
+	require.Equal(t, 3, report.Expected)
+	require.Equal(t, 3, report.Actual)
+	require.False(t, report.Mismatched())
+	reports, err := ddl.ReconcileDeleteRangeCntInRange(store, tk.Session().GetSQLExecutor(), 0, math.MaxUint64)
+	require.NoError(t, err)
+	require.Empty(t, reports)
+
+	// simulate the delete ranges of the job are lost.
+	tk.MustExec(fmt.Sprintf("delete from mysql.gc_delete_range where job_id = %d", jobID))
+	tk.MustExec(fmt.Sprintf("delete from mysql.gc_delete_range_done where job_id = %d", jobID))
+	report, err = ddl.ReconcileDeleteRangeCnt(store, tk.Session().GetSQLExecutor(), jobID)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Expected)
+	require.Equal(t, 0, report.Actual)
+	require.True(t, report.Mismatched())
+	reports, err = ddl.ReconcileDeleteRangeCntInRange(store, tk.Session().GetSQLExecutor(), 0, math.MaxUint64)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	require.Equal(t, jobID, reports[0].JobID)
+	// the job is out of the range.
+	reports, err = ddl.ReconcileDeleteRangeCntInRange(store, tk.Session().GetSQLExecutor(), 0, 1)
+	require.NoError(t, err)
+	require.Empty(t, reports)
+
+	_, err = ddl.ReconcileDeleteRangeCnt(store, tk.Session().GetSQLExecutor(), jobID+1000)
+	require.ErrorContains(t, err, "is not found in history")
+}
+
+func TestReconcileLegacyDropColumnsDeleteRangeCnt(t *testing.T) {
+	store := testkit.CreateMockStore(t)
+	tk := testkit.NewTestKit(t, store)
+
+	// ActionDropColumns jobs are no longer created, simulate one left in the
+	// history of an upgraded cluster, which dropped 2 indexes on a table
+	// with 3 partitions.
+	jobID := int64(1 << 40)
+	job := &model.Job{
+		ID:    jobID,
+		Type:  model.ActionDropColumns,
+		State: model.JobStateSynced,
+		Args: []any{
+			[]model.CIStr{model.NewCIStr("b"), model.NewCIStr("c")},
+			[]bool{false, false},
+			[]int64{5, 6},
+			[]int64{11, 12, 13},
+		},
+	}
+	ctx := kv.WithInternalSourceType(context.Background(), kv.InternalTxnDDL)
+	err := kv.RunInNewTxn(ctx, store, false, func(ctx context.Context, txn kv.Transaction) error {
+		return meta.NewMeta(txn).AddHistoryDDLJob(job, true)
+	})
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		tk.MustExec(fmt.Sprintf("insert into mysql.gc_delete_range values (%d, %d, '', '', 0)", jobID, i))
+	}
+
+	report, err := ddl.ReconcileDeleteRangeCnt(store, tk.Session().GetSQLExecutor(), jobID)
+	require.NoError(t, err)
+	require.Equal(t, model.ActionDropColumns, report.JobType)
+	require.NoError(t, report.Err)
+	require.Equal(t, 6, report.Expected)
+	require.Equal(t, 6, report.Actual)
+	require.False(t, report.Mismatched())
+}
@@ -983,6 +983,33 @@ LOOP:
 	tk.MustExec("drop table test_drop_index")
 }
 
+func TestDropIndexDeleteRangeCntOnPartitionedTable(t *testing.T) {
+	store := testkit.CreateMockStoreWithSchemaLease(t, indexModifyLease)
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec("use test")
+	tk.MustExec("set tidb_enable_global_index=true")
+	defer func() {
+		tk.MustExec("set tidb_enable_global_index=default")
+	}()
+	tk.MustExec("create table t (a int, b int, key idx_b(b)) partition by range (b)" +
+		" (partition p0 values less than (10), " +
+		"  partition p1 values less than (20), " +
+		"  partition p2 values less than (maxvalue));")
+	tk.MustExec("alter table t add unique index idx_a (a)")
+	require.True(t, external.GetTableByName(t, tk, "test", "t").Meta().FindIndexByName("idx_a").Global)
+	tk.MustExec("insert t values (1, 1), (2, 12), (3, 23)")
+
+	// the delete range sanity check runs after each DDL, also check the
+	// count here explicitly.
+	// local index, one range per partition.
+	tk.MustExec("alter table t drop index idx_b")
+	checkLastJobDeleteRangeCnt(t, tk, 3)
+	// global index, one range for the logical table.
+	tk.MustExec("alter table t drop index idx_a")
+	checkLastJobDeleteRangeCnt(t, tk, 1)
+	tk.MustExec("admin check table t")
+}
+
 func TestAnonymousIndex(t *testing.T) {
 	store := testkit.CreateMockStoreWithSchemaLease(t, indexModifyLease, mockstore.WithDDLChecker())
 
@@ -890,3 +890,25 @@ func assertMultiSchema(t *testing.T, job *model.Job, subJobLen int) {
 	assert.NotNil(t, job.MultiSchemaInfo, job)
 	assert.Len(t, job.MultiSchemaInfo.SubJobs, subJobLen, job)
 }
+
+func TestMultiSchemaChangeDropColumnsDeleteRangeCnt(t *testing.T) {
+	store := testkit.CreateMockStore(t)
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec("use test")
+	tk.MustExec("create table t (a int, b int, c int, d int, key idx_b(b), key idx_c(c), key idx_d(d)) " +
+		"partition by hash(a) partitions 3")
+	tk.MustExec("insert into t values (1, 1, 1, 1), (2, 2, 2, 2), (3, 3, 3, 3)")
+	tk.MustExec("alter table t drop column b, drop column c")
+	jobID, err := strconv.ParseInt(tk.MustQuery("admin show ddl jobs 1").Rows()[0][0].(string), 10, 64)
+	require.NoError(t, err)
+
+	// idx_b and idx_c are dropped in each of the 3 partitions.
+	report, err := ddl.ReconcileDeleteRangeCnt(store, tk.Session().GetSQLExecutor(), jobID)
+	require.NoError(t, err)
+	require.Equal(t, model.ActionMultiSchemaChange, report.JobType)
+	require.NoError(t, report.Err)
+	require.Equal(t, 6, report.Expected)
+	require.Equal(t, 6, report.Actual)
+	tk.MustQuery("select a, d from t order by a").Check(testkit.Rows("1 1", "2 2", "3 3"))
+	tk.MustExec("admin check table t")
+}
@@ -581,3 +581,28 @@ func TestReorgPartitionRollback(t *testing.T) {
 	require.NoError(t, err)
 	noNewTablesAfter(t, tk, ctx, tbl)
 }
+
+func TestReorgPartitionDeleteRangeCnt(t *testing.T) {
+	store := testkit.CreateMockStore(t)
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec("use test")
+	tk.MustExec(`create table t (a int unsigned primary key, b varchar(255), key (b))` +
+		` partition by range (a) ` +
+		`(partition p0 values less than (10),` +
+		` partition p1 values less than (20),` +
+		` partition pMax values less than (MAXVALUE))`)
+	tk.MustExec(`insert into t values (1,"1"), (12,"12"), (23,"23")`)
+
+	// the history jobs have passed the delete range sanity check, check the
+	// count again to make sure each dropped physical table has a delete range.
+	// p1 is dropped.
+	tk.MustExec("alter table t reorganize partition p1 into (partition p1a values less than (15), partition p1b values less than (20))")
+	checkLastJobDeleteRangeCnt(t, tk, 1)
+	// the 4 old partitions and the old table are dropped.
+	tk.MustExec("alter table t partition by hash(a) partitions 2")
+	checkLastJobDeleteRangeCnt(t, tk, 5)
+	// the 2 old partitions and the old table are dropped.
+	tk.MustExec("alter table t remove partitioning")
+	checkLastJobDeleteRangeCnt(t, tk, 3)
+	tk.MustExec("admin check table t")
+}
@@ -16,48 +16,179 @@ package ddl
 
 import (
 	"context"
-	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/pingcap/errors"
-	sess "github.com/pingcap/tidb/pkg/ddl/internal/session"
 	"github.com/pingcap/tidb/pkg/ddl/logutil"
 	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/meta"
 	"github.com/pingcap/tidb/pkg/parser"
 	"github.com/pingcap/tidb/pkg/parser/ast"
 	"github.com/pingcap/tidb/pkg/parser/model"
 	"github.com/pingcap/tidb/pkg/sessionctx"
 	"github.com/pingcap/tidb/pkg/util/intest"
 	"github.com/pingcap/tidb/pkg/util/mathutil"
+	"github.com/pingcap/tidb/pkg/util/sqlexec"
+	"github.com/tikv/client-go/v2/oracle"
 	"go.uber.org/zap"
 )
 
-func (d *ddl) checkDeleteRangeCnt(job *model.Job) {
-	actualCnt, err := queryDeleteRangeCnt(d.sessPool, job.ID)
+func checkDeleteRangeCnt(exec sqlexec.SQLExecutor, job *model.Job) error {
+	report, err := reconcileDeleteRangeCnt(exec, job)
 	if err != nil {
 		if strings.Contains(err.Error(), "Not Supported") {
-			return // For mock session, we don't support executing SQLs.
+			return nil // For mock session, we don't support executing SQLs.
 		}
-		logutil.DDLLogger().Error("query delete range count failed", zap.Error(err))
-		panic(err)
+		return errors.Annotate(err, "query delete range count failed")
+	}
+	if report.Err != nil {
+		return errors.Annotate(report.Err, "decode job's delete range count failed")
 	}
-	expectedCnt, err := expectedDeleteRangeCnt(delRangeCntCtx{idxIDs: map[int64]struct{}{}}, job)
+	if report.Mismatched() {
+		return errors.Errorf("job ID %d, expect delete range count %d, actual count %d", job.ID, report.Expected, report.Actual)
+	}
+	return nil
+}
+
+// DeleteRangeReport is the result of reconciling the delete ranges of a
+// history DDL job.
+type DeleteRangeReport struct {
+	JobID   int64
+	JobType model.ActionType
+	// Expected is the number of delete ranges the job should generate.
+	Expected int
+	// Actual is the number of delete ranges of the job in both
+	// mysql.gc_delete_range and mysql.gc_delete_range_done.
+	Actual int
+	// Err is set if the expected number can't be decoded from the job.
+	Err error
+}
+
+// Mismatched reports whether the delete ranges of the job are not as expected.
+func (r *DeleteRangeReport) Mismatched() bool {
+	return r.Err != nil || r.Expected != r.Actual
+}
+
+// ReconcileDeleteRangeCnt compares the delete ranges of the history DDL job
+// with the ones it should generate. It's used to diagnose leaked or missing
+// delete ranges of finished jobs. The history job is read in a new txn of the
+// store, exec is only used to query the delete range tables.
+func ReconcileDeleteRangeCnt(store kv.Storage, exec sqlexec.SQLExecutor, jobID int64) (*DeleteRangeReport, error) {
+	var job *model.Job
+	ctx := kv.WithInternalSourceType(context.Background(), kv.InternalTxnDDL)
+	err := kv.RunInNewTxn(ctx, store, false, func(_ context.Context, txn kv.Transaction) error {
+		var err error
+		job, err = meta.NewMeta(txn).GetHistoryDDLJob(jobID)
+		return err
+	})
 	if err != nil {
-		logutil.DDLLogger().Error("decode job's delete range count failed", zap.Error(err))
-		panic(err)
+		return nil, errors.Trace(err)
 	}
-	if actualCnt != expectedCnt {
-		panic(fmt.Sprintf("expect delete range count %d, actual count %d", expectedCnt, actualCnt))
+	if job == nil {
+		return nil, errors.Errorf("DDL job %d is not found in history", jobID)
 	}
+	return reconcileDeleteRangeCnt(exec, job)
 }
 
-func queryDeleteRangeCnt(sessPool *sess.Pool, jobID int64) (int, error) {
-	sctx, _ := sessPool.Get()
-	s := sctx.GetSQLExecutor()
-	defer func() {
-		sessPool.Put(sctx)
-	}()
+// deleteRangeReconcileMargin is how long before startTS the jobs are still
+// scanned by ReconcileDeleteRangeCntInRange, because a job may finish long
+// after it's created, e.g. adding an index to a large table.
+const deleteRangeReconcileMargin = 7 * 24 * time.Hour
+
+// ReconcileDeleteRangeCntInRange reconciles the delete ranges of the history
+// DDL jobs which need GC and finished between startTS and endTS, and returns
+// the reports of the mismatched ones. The history jobs are read in new txns of
+// the store, exec is only used to query the delete range tables.
+//
+// The finish order of jobs doesn't follow their IDs, so the history is scanned
+// from the latest job until a job created deleteRangeReconcileMargin before
+// startTS is met. A job which runs longer than deleteRangeReconcileMargin may
+// be created even earlier and is missed, use ReconcileDeleteRangeCnt with its
+// job ID instead.
+func ReconcileDeleteRangeCntInRange(store kv.Storage, exec sqlexec.SQLExecutor, startTS, endTS uint64) ([]*DeleteRangeReport, error) {
+	ctx := kv.WithInternalSourceType(context.Background(), kv.InternalTxnDDL)
+	scan := func(startJobID int64, limit int) (jobs []*model.Job, err error) {
+		err = kv.RunInNewTxn(ctx, store, false, func(_ context.Context, txn kv.Transaction) error {
+			jobs, err = ScanHistoryDDLJobs(meta.NewMeta(txn), startJobID, limit)
+			return err
+		})
+		return jobs, err
+	}
+	jobs, err := historyJobsFinishedInRange(scan, startTS, endTS)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var reports []*DeleteRangeReport
+	for _, job := range jobs {
+		report, err := reconcileDeleteRangeCnt(exec, job)
+		if err != nil {
+			return nil, err
+		}
+		if report.Mismatched() {
+			reports = append(reports, report)
+		}
+	}
+	return reports, nil
+}
+
+// historyJobsFinishedInRange returns the history jobs which need GC and
+// finished between startTS and endTS. scan reads the history jobs in
+// descending order of the job ID, see ScanHistoryDDLJobs, and it's called in
+// pages of batchNumHistoryJobs.
+func historyJobsFinishedInRange(
+	scan func(startJobID int64, limit int) ([]*model.Job, error),
+	startTS, endTS uint64,
+) ([]*model.Job, error) {
+	var stopTS uint64
+	if physical := oracle.ExtractPhysical(startTS); physical > deleteRangeReconcileMargin.Milliseconds() {
+		stopTS = oracle.ComposeTS(physical-deleteRangeReconcileMargin.Milliseconds(), 0)
+	}
+	var result []*model.Job
+	startJobID := int64(0)
+	for {
+		jobs, err := scan(startJobID, batchNumHistoryJobs)
+		if err != nil {
+			return nil, err
+		}
+		finished := len(jobs) < batchNumHistoryJobs
+		for _, job := range jobs {
+			if job.StartTS < stopTS {
+				finished = true
+			}
+			if job.BinlogInfo == nil {
+				continue
+			}
+			// a multi-schema change without sub-jobs is reported as malformed
+			// by reconcileDeleteRangeCnt, JobNeedGC can't check it.
+			malformed := job.Type == model.ActionMultiSchemaChange && job.MultiSchemaInfo == nil
+			if !malformed && !JobNeedGC(job) {
+				continue
+			}
+			if ts := job.BinlogInfo.FinishedTS; ts < startTS || ts > endTS {
+				continue
+			}
+			result = append(result, job)
+		}
+		if finished || jobs[len(jobs)-1].ID <= 1 {
+			return result, nil
+		}
+		startJobID = jobs[len(jobs)-1].ID - 1
+	}
+}
 
+func reconcileDeleteRangeCnt(exec sqlexec.SQLExecutor, job *model.Job) (*DeleteRangeReport, error) {
+	actualCnt, err := queryDeleteRangeCnt(exec, job.ID)
+	if err != nil {
+		return nil, err
+	}
+	report := &DeleteRangeReport{JobID: job.ID, JobType: job.Type, Actual: actualCnt}
+	report.Expected, report.Err = expectedDeleteRangeCnt(delRangeCntCtx{idxIDs: map[int64]struct{}{}}, job)
+	return report, nil
+}
+
+func queryDeleteRangeCnt(s sqlexec.SQLExecutor, jobID int64) (int, error) {
 	ctx := kv.WithInternalSourceType(context.Background(), kv.InternalTxnDDL)
 	query := `select sum(cnt) from
 	(select count(1) cnt from mysql.gc_delete_range where job_id = %? union all
@@ -135,7 +266,10 @@ func expectedDeleteRangeCnt(ctx delRangeCntCtx, job *model.Job) (int, error) {
 				return 0, errors.Trace(err)
 			}
 		}
-		return mathutil.Max(len(partitionIDs), 1), nil
+		// partitionIDs is empty for a global index, whose entries are under
+		// the logical table ID, so only 1 range is added for each index.
+		// Otherwise each partition has a range for each index.
+		return mathutil.Max(len(partitionIDs), 1) * len(indexID), nil
 	case model.ActionDropColumn:
 		var colName model.CIStr
 		var ifExists bool
@@ -146,6 +280,18 @@ func expectedDeleteRangeCnt(ctx delRangeCntCtx, job *model.Job) (int, error) {
 		}
 		physicalCnt := mathutil.Max(len(partitionIDs), 1)
 		return physicalCnt * len(indexIDs), nil
+	case model.ActionDropColumns:
+		// Deprecated, the jobs are only left in the history of clusters
+		// upgraded from old versions, new ones use multi-schema change.
+		var colNames []model.CIStr
+		var ifExists []bool
+		var indexIDs []int64
+		var partitionIDs []int64
+		if err := job.DecodeArgs(&colNames, &ifExists, &indexIDs, &partitionIDs); err != nil {
+			return 0, errors.Trace(err)
+		}
+		physicalCnt := mathutil.Max(len(partitionIDs), 1)
+		return physicalCnt * len(indexIDs), nil
 	case model.ActionModifyColumn:
 		var indexIDs []int64
 		var partitionIDs []int64
@@ -155,6 +301,9 @@ func expectedDeleteRangeCnt(ctx delRangeCntCtx, job *model.Job) (int, error) {
 		physicalCnt := mathutil.Max(len(partitionIDs), 1)
 		return physicalCnt * ctx.deduplicateIdxCnt(indexIDs), nil
 	case model.ActionMultiSchemaChange:
+		if job.MultiSchemaInfo == nil {
+			return 0, errors.Errorf("job ID %d, multi-schema change has no sub-jobs", job.ID)
+		}
 		totalExpectedCnt := 0
 		for i, sub := range job.MultiSchemaInfo.SubJobs {
 			p := sub.ToProxyJob(job, i)
@@ -165,8 +314,73 @@ func expectedDeleteRangeCnt(ctx delRangeCntCtx, job *model.Job) (int, error) {
 			totalExpectedCnt += cnt
 		}
 		return totalExpectedCnt, nil
+	default:
+		if _, ok := noDeleteRangeJobTypes[job.Type]; ok {
+			return 0, nil
+		}
+		// A new job type may generate delete ranges, but the expectation is
+		// not updated here.
+		return 0, errors.Errorf("unexpected job type %s, please update expectedDeleteRangeCnt", job.Type)
 	}
-	return 0, nil
+}
+
+// noDeleteRangeJobTypes is the job types which never generate delete ranges.
+// A new job type must be either handled by expectedDeleteRangeCnt or added
+// here, otherwise the delete range sanity check fails.
+var noDeleteRangeJobTypes = map[model.ActionType]struct{}{
+	model.ActionCreateSchema:                  {},
+	model.ActionCreateTable:                   {},
+	model.ActionCreateTables:                  {},
+	model.ActionAddColumn:                     {},
+	model.ActionAddColumns:                    {},
+	model.ActionAddForeignKey:                 {},
+	model.ActionDropForeignKey:                {},
+	model.ActionRebaseAutoID:                  {},
+	model.ActionRenameTable:                   {},
+	model.ActionRenameTables:                  {},
+	model.ActionSetDefaultValue:               {},
+	model.ActionShardRowID:                    {},
+	model.ActionModifyTableComment:            {},
+	model.ActionRenameIndex:                   {},
+	model.ActionAddTablePartition:             {},
+	model.ActionCreateView:                    {},
+	model.ActionModifyTableCharsetAndCollate:  {},
+	model.ActionDropView:                      {},
+	model.ActionRecoverTable:                  {},
+	model.ActionModifySchemaCharsetAndCollate: {},
+	model.ActionLockTable:                     {},
+	model.ActionUnlockTable:                   {},
+	model.ActionRepairTable:                   {},
+	model.ActionSetTiFlashReplica:             {},
+	model.ActionUpdateTiFlashReplicaStatus:    {},
+	model.ActionCreateSequence:                {},
+	model.ActionAlterSequence:                 {},
+	model.ActionDropSequence:                  {},
+	model.ActionModifyTableAutoIdCache:        {},
+	model.ActionRebaseAutoRandomBase:          {},
+	model.ActionAlterIndexVisibility:          {},
+	model.ActionExchangeTablePartition:        {},
+	model.ActionAddCheckConstraint:            {},
+	model.ActionDropCheckConstraint:           {},
+	model.ActionAlterCheckConstraint:          {},
+	model.ActionAlterTableAttributes:          {},
+	model.ActionAlterTablePartitionAttributes: {},
+	model.ActionCreatePlacementPolicy:         {},
+	model.ActionAlterPlacementPolicy:          {},
+	model.ActionDropPlacementPolicy:           {},
+	model.ActionAlterTablePartitionPlacement:  {},
+	model.ActionModifySchemaDefaultPlacement:  {},
+	model.ActionAlterTablePlacement:           {},
+	model.ActionAlterCacheTable:               {},
+	model.ActionAlterTableStatsOptions:        {},
+	model.ActionAlterNoCacheTable:             {},
+	model.ActionFlashbackCluster:              {},
+	model.ActionRecoverSchema:                 {},
+	model.ActionAlterTTLInfo:                  {},
+	model.ActionAlterTTLRemove:                {},
+	model.ActionCreateResourceGroup:           {},
+	model.ActionAlterResourceGroup:            {},
+	model.ActionDropResourceGroup:             {},
 }
 
 type delRangeCntCtx struct {
@@ -191,28 +405,61 @@ func (d *ddl) checkHistoryJobInTest(ctx sessionctx.Context, historyJob *model.Jo
 	if !intest.InTest {
 		return
 	}
-
-	// Check delete range.
-	if JobNeedGC(historyJob) {
-		d.checkDeleteRangeCnt(historyJob)
+	// the delete ranges are queried with a session from the pool, ctx is
+	// still executing the DDL statement.
+	se, err := d.sessPool.Get()
+	if err != nil {
+		panic(err)
 	}
+	defer d.sessPool.Put(se)
+	if err := validateHistoryJob(ctx, se.GetSQLExecutor(), historyJob); err != nil {
+		logutil.DDLLogger().Error("history job sanity check failed", zap.Error(err))
+		panic(err)
+	}
+}
 
+// ValidateHistoryJob checks the history job is consistent, i.e. the binlog
+// info, the sub-jobs of a multi-schema change, the delete ranges and the DDL
+// query match the job. Unlike checkHistoryJobInTest, it returns the error
+// instead of panicking, also for a malformed job, so it can be used to audit
+// the DDL history outside of tests. sctx provides the SQL mode to parse the
+// query, and is used to query the delete ranges.
+func ValidateHistoryJob(sctx sessionctx.Context, historyJob *model.Job) error {
+	return validateHistoryJob(sctx, sctx.GetSQLExecutor(), historyJob)
+}
+
+func validateHistoryJob(ctx sessionctx.Context, exec sqlexec.SQLExecutor, historyJob *model.Job) error {
 	// Check binlog.
+	if historyJob.BinlogInfo == nil {
+		return errors.Errorf("job ID %d, BinlogInfo is nil", historyJob.ID)
+	}
 	if historyJob.BinlogInfo.FinishedTS == 0 {
-		panic(fmt.Sprintf("job ID %d, BinlogInfo.FinishedTS is 0", historyJob.ID))
+		return errors.Errorf("job ID %d, BinlogInfo.FinishedTS is 0", historyJob.ID)
+	}
+	if historyJob.Type == model.ActionMultiSchemaChange {
+		if err := checkMultiSchemaSubJobs(historyJob); err != nil {
+			return err
+		}
+	}
+
+	// Check delete range.
+	if JobNeedGC(historyJob) {
+		if err := checkDeleteRangeCnt(exec, historyJob); err != nil {
+			return err
+		}
 	}
 
 	// Check DDL query.
 	switch historyJob.Type {
 	case model.ActionUpdateTiFlashReplicaStatus, model.ActionUnlockTable:
 		if historyJob.Query != "" {
-			panic(fmt.Sprintf("job ID %d, type %s, query %s", historyJob.ID, historyJob.Type.String(), historyJob.Query))
+			return errors.Errorf("job ID %d, type %s, query %s", historyJob.ID, historyJob.Type.String(), historyJob.Query)
 		}
-		return
+		return nil
 	default:
 		if historyJob.Query == "skip" {
 			// Skip the check if the test explicitly set the query.
-			return
+			return nil
 		}
 	}
 	p := parser.New()
@@ -220,36 +467,173 @@ func (d *ddl) checkHistoryJobInTest(ctx sessionctx.Context, historyJob *model.Jo
 	p.SetParserConfig(ctx.GetSessionVars().BuildParserConfig())
 	stmt, _, err := p.ParseSQL(historyJob.Query)
 	if err != nil {
-		panic(fmt.Sprintf("job ID %d, parse ddl job failed, query %s, err %s", historyJob.ID, historyJob.Query, err.Error()))
+		return errors.Errorf("job ID %d, parse ddl job failed, query %s, err %s", historyJob.ID, historyJob.Query, err.Error())
 	}
 	if len(stmt) != 1 && historyJob.Type != model.ActionCreateTables {
-		panic(fmt.Sprintf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query))
+		return errors.Errorf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query)
 	}
 	for _, st := range stmt {
 		switch historyJob.Type {
 		case model.ActionCreatePlacementPolicy:
 			if _, ok := st.(*ast.CreatePlacementPolicyStmt); !ok {
-				panic(fmt.Sprintf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query))
+				return errors.Errorf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query)
 			}
 		case model.ActionCreateTable:
 			if _, ok := st.(*ast.CreateTableStmt); !ok {
-				panic(fmt.Sprintf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query))
+				return errors.Errorf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query)
 			}
 		case model.ActionCreateSchema:
 			if _, ok := st.(*ast.CreateDatabaseStmt); !ok {
-				panic(fmt.Sprintf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query))
+				return errors.Errorf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query)
+			}
+		case model.ActionAddTablePartition, model.ActionDropTablePartition,
+			model.ActionTruncateTablePartition, model.ActionExchangeTablePartition:
+			if !isAlterTableWithSpec(st, partitionJobSpecTypes[historyJob.Type]) {
+				return errors.Errorf("job ID %d, type %s, query %s doesn't have the matching partition spec",
+					historyJob.ID, historyJob.Type.String(), historyJob.Query)
+			}
+		case model.ActionMultiSchemaChange:
+			if _, ok := st.(*ast.AlterTableStmt); !ok {
+				return errors.Errorf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query)
+			}
+			if cnt, ok := expectedMultiSchemaSubJobCnt(st); ok && cnt != len(historyJob.MultiSchemaInfo.SubJobs) {
+				return errors.Errorf("job ID %d, query %s expects %d sub-jobs, actual count %d",
+					historyJob.ID, historyJob.Query, cnt, len(historyJob.MultiSchemaInfo.SubJobs))
 			}
 		case model.ActionCreateTables:
 			_, isCreateTable := st.(*ast.CreateTableStmt)
 			_, isCreateSeq := st.(*ast.CreateSequenceStmt)
 			_, isCreateView := st.(*ast.CreateViewStmt)
 			if !isCreateTable && !isCreateSeq && !isCreateView {
-				panic(fmt.Sprintf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query))
+				return errors.Errorf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query)
 			}
 		default:
 			if _, ok := st.(ast.DDLNode); !ok {
-				panic(fmt.Sprintf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query))
+				return errors.Errorf("job ID %d, parse ddl job failed, query %s", historyJob.ID, historyJob.Query)
 			}
 		}
 	}
+	return nil
+}
+
+// partitionJobSpecTypes maps the partition management job types to the
+// ALTER TABLE spec types which create them.
+var partitionJobSpecTypes = map[model.ActionType][]ast.AlterTableType{
+	model.ActionAddTablePartition:      {ast.AlterTableAddPartitions, ast.AlterTableAddLastPartition},
+	model.ActionDropTablePartition:     {ast.AlterTableDropPartition, ast.AlterTableDropFirstPartition},
+	model.ActionTruncateTablePartition: {ast.AlterTableTruncatePartition},
+	model.ActionExchangeTablePartition: {ast.AlterTableExchangePartition},
+}
+
+// isAlterTableWithSpec checks st is an ALTER TABLE statement with a spec of
+// one of the types.
+func isAlterTableWithSpec(st ast.StmtNode, types []ast.AlterTableType) bool {
+	alterStmt, ok := st.(*ast.AlterTableStmt)
+	if !ok {
+		return false
+	}
+	for _, spec := range alterStmt.Specs {
+		if slices.Contains(types, spec.Tp) {
+			return true
+		}
+	}
+	return false
+}
+
+// multiSchemaSubJobSpecTypes are the ALTER TABLE spec types which create one
+// sub-job of a multi-schema change each.
+var multiSchemaSubJobSpecTypes = []ast.AlterTableType{
+	ast.AlterTableAddColumns,
+	ast.AlterTableDropColumn,
+	ast.AlterTableModifyColumn,
+	ast.AlterTableChangeColumn,
+	ast.AlterTableRenameColumn,
+	ast.AlterTableAlterColumn,
+	ast.AlterTableAddConstraint,
+	ast.AlterTableDropIndex,
+	ast.AlterTableDropPrimaryKey,
+	ast.AlterTableRenameIndex,
+}
+
+// expectedMultiSchemaSubJobCnt returns the number of sub-jobs created by the
+// ALTER TABLE statement of a multi-schema change, see ResolveAlterTableSpec
+// and mergeAddIndex. ok is false if the statement has a spec which may create
+// no or several sub-jobs, e.g. the specs with IF [NOT] EXISTS, ADD FOREIGN KEY
+// and the spec types not in multiSchemaSubJobSpecTypes.
+func expectedMultiSchemaSubJobCnt(st ast.StmtNode) (cnt int, ok bool) {
+	alterStmt, ok := st.(*ast.AlterTableStmt)
+	if !ok {
+		return 0, false
+	}
+	addIndexCnt := 0
+	// countConstraint counts the sub-jobs of an ADD CONSTRAINT spec.
+	countConstraint := func(c *ast.Constraint) bool {
+		if c.IfNotExists || (c.Option != nil && c.Option.Tp == model.IndexTypeHypo) {
+			return false
+		}
+		switch c.Tp {
+		case ast.ConstraintKey, ast.ConstraintIndex,
+			ast.ConstraintUniq, ast.ConstraintUniqIndex, ast.ConstraintUniqKey:
+			addIndexCnt++
+		case ast.ConstraintPrimaryKey:
+			cnt++
+		default:
+			return false
+		}
+		return true
+	}
+	for _, spec := range alterStmt.Specs {
+		if isIgnorableSpec(spec.Tp) {
+			continue
+		}
+		if !slices.Contains(multiSchemaSubJobSpecTypes, spec.Tp) || spec.IfExists || spec.IfNotExists {
+			return 0, false
+		}
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			cnt += len(spec.NewColumns)
+			for _, c := range spec.NewConstraints {
+				if !countConstraint(c) {
+					return 0, false
+				}
+			}
+		case ast.AlterTableAddConstraint:
+			if !countConstraint(spec.Constraint) {
+				return 0, false
+			}
+		case ast.AlterTableRenameColumn:
+			if spec.OldColumnName.Name.L == spec.NewColumnName.Name.L {
+				return 0, false
+			}
+			cnt++
+		case ast.AlterTableRenameIndex:
+			if spec.FromKey.L == spec.ToKey.L {
+				return 0, false
+			}
+			cnt++
+		default:
+			cnt++
+		}
+	}
+	// the ADD INDEX sub-jobs are merged into one.
+	return cnt + min(addIndexCnt, 1), true
+}
+
+// checkMultiSchemaSubJobs checks all the sub-jobs of a synced multi-schema
+// change are done.
+func checkMultiSchemaSubJobs(historyJob *model.Job) error {
+	if historyJob.MultiSchemaInfo == nil || len(historyJob.MultiSchemaInfo.SubJobs) == 0 {
+		return errors.Errorf("job ID %d, multi-schema change has no sub-jobs", historyJob.ID)
+	}
+	if !historyJob.IsSynced() {
+		// The sub-jobs of a rolled back job may be in any finished state.
+		return nil
+	}
+	for i, sub := range historyJob.MultiSchemaInfo.SubJobs {
+		if sub.State != model.JobStateDone {
+			return errors.Errorf("job ID %d, sub-job %d type %s, state %s is not done",
+				historyJob.ID, i, sub.Type.String(), sub.State.String())
+		}
+	}
+	return nil
 }
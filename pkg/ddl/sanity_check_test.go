@@ -0,0 +1,314 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ddl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/model"
+	"github.com/pingcap/tidb/pkg/util/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/oracle"
+)
+
+func TestExpectedDeleteRangeCntHandlesAllJobTypes(t *testing.T) {
+	// the deprecated ActionAlterTableAlterPartition is unexported and never
+	// used, it's skipped as the only job type classified as UnknownDDL.
+	require.Len(t, model.BDRActionMap[model.UnknownDDL], 1)
+	for tp := range model.ActionMap {
+		if tp == model.ActionMultiSchemaChange || model.ActionBDRMap[tp] == model.UnknownDDL {
+			continue
+		}
+		// every job type must be either handled by expectedDeleteRangeCnt or
+		// allowed to have no delete range.
+		job := &model.Job{ID: 1, Type: tp, State: model.JobStateDone, RawArgs: []byte("[]")}
+		_, err := expectedDeleteRangeCnt(delRangeCntCtx{idxIDs: map[int64]struct{}{}}, job)
+		require.NoError(t, err, tp.String())
+	}
+	// the job types which need GC can't be allowed to have no delete range.
+	for tp := range noDeleteRangeJobTypes {
+		require.False(t, JobNeedGC(&model.Job{Type: tp, State: model.JobStateDone}), tp.String())
+	}
+	_, err := expectedDeleteRangeCnt(delRangeCntCtx{idxIDs: map[int64]struct{}{}}, &model.Job{ID: 1, Type: model.ActionNone})
+	require.ErrorContains(t, err, "please update expectedDeleteRangeCnt")
+
+	job := &model.Job{
+		ID:    1,
+		Type:  model.ActionMultiSchemaChange,
+		State: model.JobStateDone,
+		MultiSchemaInfo: &model.MultiSchemaInfo{
+			SubJobs: []*model.SubJob{
+				{Type: model.ActionAddColumn, RawArgs: []byte("[]")},
+				{Type: model.ActionDropIndex, RawArgs: []byte("[]")},
+			},
+		},
+	}
+	cnt, err := expectedDeleteRangeCnt(delRangeCntCtx{idxIDs: map[int64]struct{}{}}, job)
+	require.NoError(t, err)
+	require.Equal(t, 1, cnt)
+}
+
+func TestExpectedDeleteRangeCntForPartitionReorg(t *testing.T) {
+	for _, tp := range []model.ActionType{
+		model.ActionReorganizePartition,
+		model.ActionAlterTablePartitioning,
+		model.ActionRemovePartitioning,
+	} {
+		job := &model.Job{ID: 1, Type: tp, State: model.JobStateDone, Args: []any{[]int64{11, 12, 13}}}
+		_, err := job.Encode(true)
+		require.NoError(t, err)
+		cnt, err := expectedDeleteRangeCnt(delRangeCntCtx{idxIDs: map[int64]struct{}{}}, job)
+		require.NoError(t, err)
+		require.Equal(t, 3, cnt, tp.String())
+	}
+}
+
+func TestValidateHistoryJob(t *testing.T) {
+	sctx := mock.NewContext()
+	newJob := func(tp model.ActionType, query string, finishedTS uint64) *model.Job {
+		return &model.Job{
+			ID:         1,
+			Type:       tp,
+			State:      model.JobStateSynced,
+			Query:      query,
+			BinlogInfo: &model.HistoryInfo{FinishedTS: finishedTS},
+		}
+	}
+
+	require.NoError(t, ValidateHistoryJob(sctx, newJob(model.ActionCreateTable, "create table t (a int)", 1)))
+	require.NoError(t, ValidateHistoryJob(sctx, newJob(model.ActionUnlockTable, "", 1)))
+
+	err := ValidateHistoryJob(sctx, newJob(model.ActionCreateTable, "create table t (a int)", 0))
+	require.ErrorContains(t, err, "job ID 1, BinlogInfo.FinishedTS is 0")
+	// the malformed jobs return errors instead of panicking.
+	job := newJob(model.ActionDropTable, "drop table t", 1)
+	job.BinlogInfo = nil
+	err = ValidateHistoryJob(sctx, job)
+	require.ErrorContains(t, err, "job ID 1, BinlogInfo is nil")
+	job = newJob(model.ActionMultiSchemaChange, "alter table t drop index a, drop index b", 1)
+	err = ValidateHistoryJob(sctx, job)
+	require.ErrorContains(t, err, "job ID 1, multi-schema change has no sub-jobs")
+	_, err = expectedDeleteRangeCnt(delRangeCntCtx{idxIDs: map[int64]struct{}{}}, job)
+	require.ErrorContains(t, err, "job ID 1, multi-schema change has no sub-jobs")
+	err = ValidateHistoryJob(sctx, newJob(model.ActionUnlockTable, "unlock tables", 1))
+	require.ErrorContains(t, err, "job ID 1, type unlock table, query unlock tables")
+	err = ValidateHistoryJob(sctx, newJob(model.ActionCreateTable, "create database db", 1))
+	require.ErrorContains(t, err, "job ID 1, parse ddl job failed, query create database db")
+	err = ValidateHistoryJob(sctx, newJob(model.ActionCreateTable, "create table", 1))
+	require.ErrorContains(t, err, "job ID 1, parse ddl job failed, query create table, err")
+}
+
+func TestValidateMultiSchemaChangeHistoryJob(t *testing.T) {
+	sctx := mock.NewContext()
+	job := &model.Job{
+		ID:         1,
+		Type:       model.ActionMultiSchemaChange,
+		State:      model.JobStateSynced,
+		Query:      "alter table t add column b int, rename index idx to idx2",
+		BinlogInfo: &model.HistoryInfo{FinishedTS: 1},
+		MultiSchemaInfo: &model.MultiSchemaInfo{
+			SubJobs: []*model.SubJob{
+				{Type: model.ActionAddColumn, State: model.JobStateDone},
+				{Type: model.ActionRenameIndex, State: model.JobStateDone},
+			},
+		},
+	}
+	require.NoError(t, ValidateHistoryJob(sctx, job))
+
+	job.MultiSchemaInfo.SubJobs[1].State = model.JobStateCancelled
+	err := ValidateHistoryJob(sctx, job)
+	require.ErrorContains(t, err, "job ID 1, sub-job 1 type rename index, state cancelled is not done")
+	// the sub-jobs of a rolled back job are not checked.
+	job.State = model.JobStateRollbackDone
+	require.NoError(t, ValidateHistoryJob(sctx, job))
+
+	job.State = model.JobStateSynced
+	job.MultiSchemaInfo.SubJobs[1].State = model.JobStateDone
+	job.Query = "create table t (a int)"
+	err = ValidateHistoryJob(sctx, job)
+	require.ErrorContains(t, err, "job ID 1, parse ddl job failed, query create table t (a int)")
+
+	// the number of sub-jobs must match the specs of the query.
+	job.Query = "alter table t add column b int, rename index idx to idx2, drop column c"
+	err = ValidateHistoryJob(sctx, job)
+	require.ErrorContains(t, err, "job ID 1, query alter table t add column b int, rename index idx to idx2, drop column c expects 3 sub-jobs, actual count 2")
+	job.Query = "alter table t add column b int, algorithm = inplace, rename index idx to idx2"
+	require.NoError(t, ValidateHistoryJob(sctx, job))
+}
+
+func TestExpectedMultiSchemaSubJobCnt(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		cnt   int
+		ok    bool
+	}{
+		{"alter table t add column b int, drop column c", 2, true},
+		{"alter table t add column (b int, c int), modify column d bigint", 3, true},
+		{"alter table t add column b int, lock = none, algorithm = instant", 1, true},
+		// the ADD INDEX sub-jobs are merged into one.
+		{"alter table t add index i1(a), add unique index i2(b), add primary key(c)", 2, true},
+		{"alter table t add column (b int, index i1(b)), add index i2(a)", 2, true},
+		{"alter table t rename column a to b, rename index i1 to i2, alter column c set default 1", 3, true},
+		// the specs which may create no or several sub-jobs.
+		{"alter table t add column if not exists b int, drop column c", 0, false},
+		{"alter table t drop index if exists i1, drop column c", 0, false},
+		{"alter table t add foreign key (a) references t2(a), drop column c", 0, false},
+		{"alter table t rename index i1 to I1, drop column c", 0, false},
+		{"alter table t comment = 'x', auto_increment = 10, drop column c", 0, false},
+		{"create table t (a int)", 0, false},
+	} {
+		st, err := parser.New().ParseOneStmt(c.query, "", "")
+		require.NoError(t, err, c.query)
+		cnt, ok := expectedMultiSchemaSubJobCnt(st)
+		require.Equal(t, c.ok, ok, c.query)
+		require.Equal(t, c.cnt, cnt, c.query)
+	}
+}
+
+func TestExpectedDeleteRangeCntForDropIndex(t *testing.T) {
+	for _, c := range []struct {
+		args     []any
+		expected int
+	}{
+		// local index of a partitioned table.
+		{args: []any{model.NewCIStr("idx"), false, int64(5), []int64{11, 12, 13}}, expected: 3},
+		// global index of a partitioned table.
+		{args: []any{model.NewCIStr("idx"), false, int64(5), []int64{}}, expected: 1},
+		// non-partitioned table.
+		{args: []any{model.NewCIStr("idx"), false, int64(5)}, expected: 1},
+		// multiple indexes.
+		{args: []any{[]model.CIStr{model.NewCIStr("idx1"), model.NewCIStr("idx2")}, []bool{false, false}, []int64{5, 6}, []int64{11, 12}}, expected: 4},
+	} {
+		job := &model.Job{ID: 1, Type: model.ActionDropIndex, State: model.JobStateDone, Args: c.args}
+		_, err := job.Encode(true)
+		require.NoError(t, err)
+		cnt, err := expectedDeleteRangeCnt(delRangeCntCtx{idxIDs: map[int64]struct{}{}}, job)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, cnt, c.args)
+	}
+}
+
+func TestExpectedDeleteRangeCntForDropColumns(t *testing.T) {
+	colNames := []model.CIStr{model.NewCIStr("a"), model.NewCIStr("b")}
+	for _, c := range []struct {
+		tp       model.ActionType
+		args     []any
+		expected int
+	}{
+		// the dropped columns have 2 indexes on a table with 3 partitions.
+		{tp: model.ActionDropColumns, args: []any{colNames, []bool{false, false}, []int64{5, 6}, []int64{11, 12, 13}}, expected: 6},
+		{tp: model.ActionDropColumns, args: []any{colNames, []bool{false, false}, []int64{5, 6}, []int64{}}, expected: 2},
+		{tp: model.ActionDropColumns, args: []any{colNames, []bool{false, false}, []int64{}, []int64{11, 12}}, expected: 0},
+		// adding columns never generates delete ranges.
+		{tp: model.ActionAddColumns, args: []any{}, expected: 0},
+	} {
+		job := &model.Job{ID: 1, Type: c.tp, State: model.JobStateDone, Args: c.args}
+		_, err := job.Encode(true)
+		require.NoError(t, err)
+		cnt, err := expectedDeleteRangeCnt(delRangeCntCtx{idxIDs: map[int64]struct{}{}}, job)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, cnt, c.args)
+	}
+}
+
+func TestValidatePartitionHistoryJobQuery(t *testing.T) {
+	sctx := mock.NewContext()
+	for _, c := range []struct {
+		tp    model.ActionType
+		query string
+		valid bool
+	}{
+		{model.ActionAddTablePartition, "alter table t add partition (partition p3 values less than (30))", true},
+		{model.ActionAddTablePartition, "alter table t last partition less than (30)", true},
+		{model.ActionAddTablePartition, "alter table t drop partition p0", false},
+		{model.ActionDropTablePartition, "alter table t drop partition p0", true},
+		{model.ActionDropTablePartition, "alter table t first partition less than (10)", true},
+		{model.ActionDropTablePartition, "alter table t truncate partition p0", false},
+		{model.ActionTruncateTablePartition, "alter table t truncate partition p0", true},
+		{model.ActionTruncateTablePartition, "truncate table t", false},
+		{model.ActionExchangeTablePartition, "alter table t exchange partition p0 with table t2", true},
+		{model.ActionExchangeTablePartition, "alter table t add column c int", false},
+		{model.ActionExchangeTablePartition, "create table t2 (a int)", false},
+	} {
+		// Use a cancelled job to skip the delete range check.
+		job := &model.Job{
+			ID:         1,
+			Type:       c.tp,
+			State:      model.JobStateCancelled,
+			Query:      c.query,
+			BinlogInfo: &model.HistoryInfo{FinishedTS: 1},
+		}
+		err := ValidateHistoryJob(sctx, job)
+		if c.valid {
+			require.NoError(t, err, c.query)
+		} else {
+			require.ErrorContains(t, err, "doesn't have the matching partition spec", c.query)
+		}
+	}
+}
+
+func TestHistoryJobsFinishedInRange(t *testing.T) {
+	base := oracle.GetPhysical(time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC))
+	ts := func(d time.Duration) uint64 {
+		return oracle.ComposeTS(base+d.Milliseconds(), 0)
+	}
+	newJob := func(id int64, tp model.ActionType, start, finish time.Duration) *model.Job {
+		return &model.Job{
+			ID: id, Type: tp, State: model.JobStateSynced, StartTS: ts(start),
+			BinlogInfo: &model.HistoryInfo{FinishedTS: ts(finish)},
+		}
+	}
+	// the history in descending order of the job ID, the jobs on the first
+	// page except the top 2 are created more than deleteRangeReconcileMargin
+	// before startTS, so the scan stops after it.
+	n := int64(batchNumHistoryJobs + 2)
+	history := []*model.Job{
+		newJob(n+1, model.ActionDropTable, -time.Hour, 2*time.Hour),
+		newJob(n, model.ActionDropTable, -time.Hour, 10*time.Minute),
+	}
+	for id := n - 1; id > 2; id-- {
+		history = append(history, newJob(id, model.ActionCreateTable, -8*24*time.Hour, -8*24*time.Hour))
+	}
+	// a job which runs longer than deleteRangeReconcileMargin is missed.
+	history = append(history, newJob(2, model.ActionDropTable, -9*24*time.Hour, 20*time.Minute))
+	history = append(history, newJob(1, model.ActionDropTable, -9*24*time.Hour, -9*24*time.Hour))
+
+	scanned := 0
+	scan := func(startJobID int64, limit int) ([]*model.Job, error) {
+		scanned++
+		i := 0
+		if startJobID > 0 {
+			for i < len(history) && history[i].ID > startJobID {
+				i++
+			}
+		}
+		return history[i:min(i+limit, len(history))], nil
+	}
+	jobs, err := historyJobsFinishedInRange(scan, ts(0), ts(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, n, jobs[0].ID)
+	require.Equal(t, 1, scanned)
+
+	// startTS 0 leaves no margin, the whole history is scanned in pages.
+	scanned = 0
+	jobs, err = historyJobsFinishedInRange(scan, 0, ts(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+	require.Equal(t, []int64{n, 2, 1}, []int64{jobs[0].ID, jobs[1].ID, jobs[2].ID})
+	require.Equal(t, 2, scanned)
+}
@@ -95,6 +95,7 @@ func TestFileChunkProcess(t *testing.T) {
 				FieldMappings: fieldMappings,
 			},
 		},
+		nil,
 	)
 	require.NoError(t, err)
 	diskQuotaLock := &syncutil.RWMutex{}
@@ -78,7 +78,7 @@ func ProcessChunkWithWriter(
 	logger *zap.Logger,
 	groupChecksum *verification.KVGroupChecksum,
 ) error {
-	encoder, err := tableImporter.getKVEncoder(chunk)
+	encoder, err := tableImporter.getKVEncoder(ctx, chunk)
 	if err != nil {
 		return err
 	}
@@ -24,6 +24,7 @@ import (
 	"github.com/pingcap/tidb/pkg/lightning/backend/encode"
 	"github.com/pingcap/tidb/pkg/lightning/backend/kv"
 	"github.com/pingcap/tidb/pkg/lightning/common"
+	"github.com/pingcap/tidb/pkg/lightning/metric"
 	"github.com/pingcap/tidb/pkg/meta/autoid"
 	"github.com/pingcap/tidb/pkg/parser/ast"
 	"github.com/pingcap/tidb/pkg/parser/mysql" //nolint: goimports
@@ -53,16 +54,20 @@ type tableKVEncoder struct {
 
 var _ KVEncoder = &tableKVEncoder{}
 
-// NewTableKVEncoder creates a new tableKVEncoder.
+// NewTableKVEncoder creates a new tableKVEncoder. metrics can be nil.
 // exported for test.
 func NewTableKVEncoder(
 	config *encode.EncodingConfig,
 	ti *TableImporter,
+	metrics *metric.Common,
 ) (KVEncoder, error) {
 	baseKVEncoder, err := kv.NewBaseKVEncoder(config)
 	if err != nil {
 		return nil, err
 	}
+	if metrics != nil {
+		baseKVEncoder.SetMetrics(metrics)
+	}
 	// we need a non-nil TxnCtx to avoid panic when evaluating set clause
 	baseKVEncoder.SessionCtx.Vars.TxnCtx = new(variable.TransactionContext)
 	colAssignExprs, _, err := ti.CreateColAssignExprs(baseKVEncoder.SessionCtx)
@@ -218,6 +223,9 @@ func (en *tableKVEncoder) fillRow(row []types.Datum, hasValue []bool, rowID int6
 }
 
 func (en *tableKVEncoder) Close() error {
+	// the allocators must cover all the IDs used by the encoded rows, see
+	// encode.EncodingConfig.DeferAutoIDRebase.
+	err := en.RebaseAutoIDs()
 	en.SessionCtx.Close()
-	return nil
+	return errors.Trace(err)
 }
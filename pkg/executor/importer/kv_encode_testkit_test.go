@@ -0,0 +1,105 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer_test
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/pkg/executor/importer"
+	"github.com/pingcap/tidb/pkg/lightning/backend/encode"
+	"github.com/pingcap/tidb/pkg/lightning/backend/kv"
+	"github.com/pingcap/tidb/pkg/lightning/log"
+	"github.com/pingcap/tidb/pkg/lightning/metric"
+	"github.com/pingcap/tidb/pkg/meta/autoid"
+	"github.com/pingcap/tidb/pkg/parser/model"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/session"
+	"github.com/pingcap/tidb/pkg/table"
+	"github.com/pingcap/tidb/pkg/table/tables"
+	"github.com/pingcap/tidb/pkg/testkit"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/promutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTableKVEncoder(
+	t *testing.T,
+	createSQL string,
+	config *encode.EncodingConfig,
+	metrics *metric.Common,
+) (importer.KVEncoder, table.Table) {
+	store := testkit.CreateMockStore(t)
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec(createSQL)
+	do, err := session.GetDomain(store)
+	require.NoError(t, err)
+	tbl, err := do.InfoSchema().TableByName(model.NewCIStr("test"), model.NewCIStr("t"))
+	require.NoError(t, err)
+	tblInfo := tbl.Meta()
+	// use the same allocators as IMPORT INTO.
+	tbl, err = tables.TableFromMeta(kv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+
+	fieldMappings := make([]*importer.FieldMapping, 0, len(tbl.VisibleCols()))
+	for _, col := range tbl.VisibleCols() {
+		fieldMappings = append(fieldMappings, &importer.FieldMapping{Column: col})
+	}
+	config.SessionOptions.SQLMode = mysql.ModeStrictAllTables
+	config.Table = tbl
+	config.Logger = log.L()
+	encoder, err := importer.NewTableKVEncoder(config, &importer.TableImporter{
+		LoadDataController: &importer.LoadDataController{
+			ASTArgs:       &importer.ASTArgs{},
+			InsertColumns: tbl.VisibleCols(),
+			FieldMappings: fieldMappings,
+		},
+	}, metrics)
+	require.NoError(t, err)
+	return encoder, tbl
+}
+
+func TestTableKVEncoderCloseRebasesAutoIDs(t *testing.T) {
+	encoder, tbl := newTestTableKVEncoder(t, "create table test.t(id bigint primary key auto_increment, v int)",
+		&encode.EncodingConfig{DeferAutoIDRebase: true}, nil)
+	alloc := tbl.Allocators(nil).Get(autoid.AutoIncrementType)
+
+	for i, id := range []string{"5", "500", "3"} {
+		_, err := encoder.Encode([]types.Datum{types.NewStringDatum(id), types.NewStringDatum("1")}, int64(i+1))
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(0), alloc.Base())
+	require.NoError(t, encoder.Close())
+	require.Equal(t, int64(500), alloc.Base())
+}
+
+func TestTableKVEncoderCountsConvertFailed(t *testing.T) {
+	metrics := metric.NewCommon(promutil.NewDefaultFactory(), "test", "", nil)
+	encoder, _ := newTestTableKVEncoder(t, "create table test.t(id int primary key, v tinyint)",
+		&encode.EncodingConfig{}, metrics)
+	counter := func(tp string) float64 {
+		return metric.ReadCounter(metrics.KvConvertFailedCounter.WithLabelValues(tp))
+	}
+
+	_, err := encoder.Encode([]types.Datum{types.NewStringDatum("1"), types.NewStringDatum("1")}, 1)
+	require.NoError(t, err)
+	require.Equal(t, float64(0), counter("tinyint"))
+	_, err = encoder.Encode([]types.Datum{types.NewStringDatum("2"), types.NewStringDatum("1000")}, 2)
+	require.ErrorContains(t, err, "for column `v`")
+	_, err = encoder.Encode([]types.Datum{types.NewStringDatum("3"), types.NewStringDatum("abc")}, 3)
+	require.ErrorContains(t, err, "for column `v`")
+	require.Equal(t, float64(2), counter("tinyint"))
+	require.Equal(t, float64(0), counter("int"))
+	require.NoError(t, encoder.Close())
+}
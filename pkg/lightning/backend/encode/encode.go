@@ -16,6 +16,8 @@ package encode
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	"github.com/pingcap/tidb/pkg/lightning/log"
 	"github.com/pingcap/tidb/pkg/lightning/verification"
@@ -30,8 +32,58 @@ type EncodingConfig struct {
 	Path   string // path of data file
 	Table  table.Table
 	Logger log.Logger
+	// CollectRowErrors makes EncodeBatch skip the rows which fail to convert
+	// and collect their errors into RowErrors, instead of failing on the
+	// first bad row.
+	CollectRowErrors bool
+	// BadNullPolicies maps column names to the policy used when the column is
+	// NOT NULL but the source row has a NULL value for it. The columns not in
+	// the map follow the SQL mode.
+	BadNullPolicies map[string]BadNullPolicy
+	// DefaultValueOverrides maps column names to the values used instead of the
+	// schema default when the source row has no value for the column. Generated
+	// and auto-id columns can't be overridden.
+	DefaultValueOverrides map[string]types.Datum
+	// DeferAutoIDRebase makes the encoder only record the max value seen for
+	// the auto-increment, auto-random and auto row ID columns instead of
+	// rebasing the allocators on every row. EncodeBatch rebases them once at
+	// the end of the batch, for the other encode methods they are rebased by
+	// RebaseAutoIDs of the encoder. The encoders of the local backend and
+	// IMPORT INTO also rebase them when they are closed, but the IMPORT INTO
+	// encoder always rebases the auto row ID at once. The TiDB backend doesn't
+	// allocate IDs, so it ignores this option.
+	DeferAutoIDRebase bool
+	// ReportGeneratedColumns makes the encoder attach the evaluated values of
+	// the generated columns to each encoded row, so they can be checked by the
+	// caller, e.g. when validating the expressions with a test import.
+	ReportGeneratedColumns bool
+	// DeterministicShardRowID makes the encoder fill the shard bits of the row
+	// IDs of a SHARD_ROW_ID_BITS table with kv.ShardRowID. It yields different
+	// keys from the default sharding for the same row, so all the encoders
+	// writing to the same table must agree on it.
+	DeterministicShardRowID bool
+	// ValidateRowPartition makes EncodeToPartition of the encoder evaluate the
+	// partition expression of each row, and fail if the row doesn't belong to
+	// the requested partition. It's for debugging the caller, as it costs the
+	// same as letting the encoder route the rows.
+	ValidateRowPartition bool
 }
 
+// BadNullPolicy is the policy to handle a NULL value for a NOT NULL column.
+type BadNullPolicy int
+
+const (
+	// BadNullBySQLMode uses the zero value of the column if the SQL mode is not
+	// strict, otherwise rejects the row.
+	BadNullBySQLMode BadNullPolicy = iota
+	// BadNullAsZero always uses the zero value of the column.
+	BadNullAsZero
+	// BadNullReject always rejects the row. Like other values which fail to
+	// convert, the row is skipped if CollectRowErrors is set, otherwise the
+	// encoding fails.
+	BadNullReject
+)
+
 // EncodingBuilder consists of operations to handle encoding backend row data formats from source.
 type EncodingBuilder interface {
 	// NewEncoder creates an encoder of a TiDB table.
@@ -48,6 +100,39 @@ type Encoder interface {
 
 	// Encode encodes a row of SQL values into a backend-friendly format.
 	Encode(row []types.Datum, rowID int64, columnPermutation []int, offset int64) (Row, error)
+
+	// EncodeBatch encodes a batch of rows, the i-th row uses firstRowID+i as
+	// its row ID and offsets[i] as its offset, so offsets must have the same
+	// length as rows. The result is the same as calling Encode on each row.
+	// If EncodingConfig.CollectRowErrors is set, the rows failed to convert
+	// are skipped, and the returned error is a RowErrors along with the rows
+	// that are encoded successfully.
+	EncodeBatch(rows [][]types.Datum, firstRowID int64, columnPermutation []int, offsets []int64) ([]Row, error)
+}
+
+// RowError is the error of a single row in EncodeBatch.
+type RowError struct {
+	// Index is the index of the row in the batch.
+	Index  int
+	RowID  int64
+	Offset int64
+	// Column is the name of the column whose value fails to convert.
+	Column string
+	Err    error
+}
+
+// RowErrors is the collected errors of the rows skipped by EncodeBatch.
+type RowErrors []RowError
+
+// Error implements the error interface.
+func (e RowErrors) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d rows failed to encode", len(e))
+	for _, rowErr := range e {
+		fmt.Fprintf(&sb, "; row %d (rowID %d, offset %d, column %s): %v",
+			rowErr.Index, rowErr.RowID, rowErr.Offset, rowErr.Column, rowErr.Err)
+	}
+	return sb.String()
 }
 
 // SessionOptions is the initial configuration of the session.
@@ -16,7 +16,11 @@ package kv
 
 import (
 	"context"
+	"encoding/binary"
+	"fmt"
 	"math/rand"
+	"slices"
+	"strings"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/br/pkg/logutil"
@@ -24,6 +28,7 @@ import (
 	"github.com/pingcap/tidb/pkg/lightning/backend/encode"
 	"github.com/pingcap/tidb/pkg/lightning/common"
 	"github.com/pingcap/tidb/pkg/lightning/log"
+	"github.com/pingcap/tidb/pkg/lightning/metric"
 	"github.com/pingcap/tidb/pkg/meta/autoid"
 	"github.com/pingcap/tidb/pkg/parser/model"
 	"github.com/pingcap/tidb/pkg/parser/mysql"
@@ -34,12 +39,14 @@ import (
 	"github.com/pingcap/tidb/pkg/util/chunk"
 	"github.com/pingcap/tidb/pkg/util/codec"
 	"github.com/pingcap/tidb/pkg/util/redact"
+	"github.com/twmb/murmur3"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 const (
-	maxLogLength = 512 * 1024
+	maxLogLength     = 512 * 1024
+	maxJSONLogLength = 1024
 )
 
 // ExtraHandleColumnInfo is the column info of extra handle column.
@@ -86,7 +93,6 @@ func (row RowArrayMarshaller) MarshalLogArray(encoder zapcore.ArrayEncoder) erro
 	for _, datum := range row {
 		kind := datum.Kind()
 		var str string
-		var err error
 		switch kind {
 		case types.KindNull:
 			str = "NULL"
@@ -94,10 +100,19 @@ func (row RowArrayMarshaller) MarshalLogArray(encoder zapcore.ArrayEncoder) erro
 			str = "-inf"
 		case types.KindMaxValue:
 			str = "+inf"
+		case types.KindMysqlJSON:
+			str = jsonLogString(datum.GetMysqlJSON())
+		case types.KindMysqlTime:
+			t := datum.GetMysqlTime()
+			str = fmt.Sprintf("%s '%s'", strings.ToUpper(types.TypeStr(t.Type())), t.String())
+		case types.KindMysqlDuration:
+			str = fmt.Sprintf("TIME '%s'", datum.GetMysqlDuration().String())
 		default:
+			var err error
 			str, err = datum.ToString()
 			if err != nil {
-				return err
+				// one bad value shouldn't hide the rest of the row.
+				str = fmt.Sprintf("(unprintable %s value: %s)", kindStr[kind], err.Error())
 			}
 		}
 		if len(str) > maxLogLength {
@@ -119,6 +134,17 @@ func (row RowArrayMarshaller) MarshalLogArray(encoder zapcore.ArrayEncoder) erro
 	return nil
 }
 
+// jsonLogString renders the JSON value for logging. A value longer than
+// maxJSONLogLength is logged as a JSON string holding its prefix, so that the
+// output is always valid JSON.
+func jsonLogString(j types.BinaryJSON) string {
+	str := j.String()
+	if len(str) <= maxJSONLogLength {
+		return str
+	}
+	return types.CreateBinaryJSON(strings.ToValidUTF8(str[:maxJSONLogLength], "") + "... (truncated)").String()
+}
+
 // BaseKVEncoder encodes a row into a KV pair.
 type BaseKVEncoder struct {
 	GenCols         []GeneratedCol
@@ -129,8 +155,15 @@ type BaseKVEncoder struct {
 	// convert auto id for shard rowid or auto random id base on row id generated by lightning
 	AutoIDFn AutoIDConverterFn
 
-	logger      *zap.Logger
-	recordCache []types.Datum
+	logger           *zap.Logger
+	metrics          *metric.Common
+	recordCache      []types.Datum
+	bufPool          *BufferPool
+	defaultOverrides map[int64]types.Datum
+	badNullPolicies  map[int64]encode.BadNullPolicy
+	// pendingRebases is the max value to rebase each allocator to, it's only
+	// set when EncodingConfig.DeferAutoIDRebase is on.
+	pendingRebases map[autoid.AllocatorType]int64
 }
 
 // NewBaseKVEncoder creates a new BaseKVEncoder.
@@ -153,7 +186,15 @@ func NewBaseKVEncoder(config *encode.EncodingConfig) (*BaseKVEncoder, error) {
 		autoIDFn = func(id int64) int64 {
 			return shardFmt.Compose(shard, id)
 		}
+	} else if meta.ShardRowIDBits > 0 && config.DeterministicShardRowID {
+		seed, shardRowIDBits := config.AutoRandomSeed, meta.ShardRowIDBits
+		autoIDFn = func(id int64) int64 {
+			return ShardRowID(seed, id, shardRowIDBits)
+		}
 	} else if meta.ShardRowIDBits > 0 {
+		// keep the legacy shard bits by default, the row IDs of a chunk must not
+		// change when it's re-encoded by an encoder of another version, e.g.
+		// when resuming from a checkpoint or during a rolling upgrade.
 		rd := rand.New(rand.NewSource(config.AutoRandomSeed)) // nolint:gosec
 		mask := int64(1)<<meta.ShardRowIDBits - 1
 		shift := autoid.RowIDBitLength - meta.ShardRowIDBits - 1
@@ -169,6 +210,18 @@ func NewBaseKVEncoder(config *encode.EncodingConfig) (*BaseKVEncoder, error) {
 	if err != nil {
 		return nil, errors.Annotate(err, "failed to parse generated column expressions")
 	}
+	defaultOverrides, err := collectDefaultOverrides(meta, cols, autoRandomColID, config.DefaultValueOverrides)
+	if err != nil {
+		return nil, err
+	}
+	badNullPolicies, err := collectBadNullPolicies(cols, config.BadNullPolicies)
+	if err != nil {
+		return nil, err
+	}
+	var pendingRebases map[autoid.AllocatorType]int64
+	if config.DeferAutoIDRebase {
+		pendingRebases = make(map[autoid.AllocatorType]int64, 3)
+	}
 	return &BaseKVEncoder{
 		GenCols:         genCols,
 		SessionCtx:      se,
@@ -177,20 +230,112 @@ func NewBaseKVEncoder(config *encode.EncodingConfig) (*BaseKVEncoder, error) {
 		AutoRandomColID: autoRandomColID,
 		AutoIDFn:        autoIDFn,
 		logger:          config.Logger.Logger,
+
+		defaultOverrides: defaultOverrides,
+		badNullPolicies:  badNullPolicies,
+		pendingRebases:   pendingRebases,
 	}, nil
 }
 
+// collectDefaultOverrides resolves the column names of the default value
+// overrides into column IDs.
+func collectDefaultOverrides(
+	meta *model.TableInfo,
+	cols []*table.Column,
+	autoRandomColID int64,
+	overrides map[string]types.Datum,
+) (map[int64]types.Datum, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+	res := make(map[int64]types.Datum, len(overrides))
+	for name, value := range overrides {
+		col := table.FindCol(cols, name)
+		if col == nil {
+			return nil, errors.Errorf("unknown column %s in default value overrides", name)
+		}
+		if col.IsGenerated() || IsAutoIncCol(col.ToInfo()) ||
+			(meta.ContainsAutoRandomBits() && col.ID == autoRandomColID) {
+			return nil, errors.Errorf("can't override the default value of generated or auto-id column %s", col.Name.O)
+		}
+		res[col.ID] = value
+	}
+	return res, nil
+}
+
+// collectBadNullPolicies resolves the column names of the bad null policies
+// into column IDs.
+func collectBadNullPolicies(
+	cols []*table.Column,
+	policies map[string]encode.BadNullPolicy,
+) (map[int64]encode.BadNullPolicy, error) {
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	res := make(map[int64]encode.BadNullPolicy, len(policies))
+	for name, policy := range policies {
+		col := table.FindCol(cols, name)
+		if col == nil {
+			return nil, errors.Errorf("unknown column %s in bad null policies", name)
+		}
+		res[col.ID] = policy
+	}
+	return res, nil
+}
+
+// ShardRowID fills the shard bits of the row ID for a table with
+// SHARD_ROW_ID_BITS. The shard bits are taken from the murmur3 hash of the seed
+// and the row ID, so the same seed and row ID always get the same shard, and
+// the shards are uniformly distributed. The sign bit is reserved like TiDB.
+// It's only used when EncodingConfig.DeterministicShardRowID is set.
+func ShardRowID(seed, id int64, shardRowIDBits uint64) int64 {
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(seed))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(id))
+	mask := int64(1)<<shardRowIDBits - 1
+	shift := autoid.RowIDBitLength - shardRowIDBits - 1
+	return (int64(murmur3.Sum32(buf[:]))&mask)<<shift | id
+}
+
+// SetMetrics sets the metrics to record the values failed to convert.
+func (e *BaseKVEncoder) SetMetrics(metrics *metric.Common) {
+	e.metrics = metrics
+}
+
 // GetOrCreateRecord returns a record slice from the cache if possible, otherwise creates a new one.
 func (e *BaseKVEncoder) GetOrCreateRecord() []types.Datum {
 	if e.recordCache != nil {
 		return e.recordCache
 	}
+	if e.bufPool != nil {
+		return e.bufPool.getRecord(len(e.Columns) + 1)
+	}
 	return make([]types.Datum, 0, len(e.Columns)+1)
 }
 
+// setBufferPool makes the encoder take its buffers from pool.
+func (e *BaseKVEncoder) setBufferPool(pool *BufferPool) {
+	e.bufPool = pool
+	e.SessionCtx.txn.MemBuf.pool = pool
+}
+
+// releaseRecord returns the cached record slice to the buffer pool.
+func (e *BaseKVEncoder) releaseRecord() {
+	if e.bufPool != nil && e.recordCache != nil {
+		e.bufPool.putRecord(e.recordCache)
+	}
+	e.recordCache = nil
+}
+
 // Record2KV converts a row into a KV pair.
 func (e *BaseKVEncoder) Record2KV(record, originalRow []types.Datum, rowID int64) (*Pairs, error) {
-	_, err := e.Table.AddRecord(e.SessionCtx.GetTableCtx(), record)
+	return e.record2KV(e.Table, record, originalRow, rowID)
+}
+
+// record2KV converts a row into a KV pair by adding it into tbl, which is
+// either e.Table or one of its partitions.
+func (e *BaseKVEncoder) record2KV(tbl table.Table, record, originalRow []types.Datum, rowID int64) (*Pairs, error) {
+	_, err := tbl.AddRecord(e.SessionCtx.GetTableCtx(), record)
 	if err != nil {
 		e.logger.Error("kv encode failed",
 			zap.Array("originalRow", RowArrayMarshaller(originalRow)),
@@ -212,6 +357,7 @@ func (e *BaseKVEncoder) Record2KV(record, originalRow []types.Datum, rowID int64
 func (e *BaseKVEncoder) ProcessColDatum(col *table.Column, rowID int64, inputDatum *types.Datum) (types.Datum, error) {
 	value, err := e.getActualDatum(col, rowID, inputDatum)
 	if err != nil {
+		e.countConvertFailed(col.ToInfo())
 		return value, err
 	}
 
@@ -219,21 +365,51 @@ func (e *BaseKVEncoder) ProcessColDatum(col *table.Column, rowID int64, inputDat
 		meta := e.Table.Meta()
 		shardFmt := autoid.NewShardIDFormat(&col.FieldType, meta.AutoRandomBits, meta.AutoRandomRangeBits)
 		// this allocator is the same as the allocator in table importer, i.e. PanickingAllocators. below too.
-		alloc := e.Table.Allocators(e.SessionCtx.GetTableCtx()).Get(autoid.AutoRandomType)
-		if err := alloc.Rebase(context.Background(), value.GetInt64()&shardFmt.IncrementalMask(), false); err != nil {
-			return value, errors.Trace(err)
+		if err := e.rebaseAutoID(autoid.AutoRandomType, value.GetInt64()&shardFmt.IncrementalMask()); err != nil {
+			return value, err
 		}
 	}
 	if IsAutoIncCol(col.ToInfo()) {
 		// same as RowIDAllocType, since SepAutoInc is always false when initializing allocators of Table.
-		alloc := e.Table.Allocators(e.SessionCtx.GetTableCtx()).Get(autoid.AutoIncrementType)
-		if err := alloc.Rebase(context.Background(), GetAutoRecordID(value, &col.FieldType), false); err != nil {
-			return value, errors.Trace(err)
+		if err := e.rebaseAutoID(autoid.AutoIncrementType, GetAutoRecordID(value, &col.FieldType)); err != nil {
+			return value, err
 		}
 	}
 	return value, nil
 }
 
+// rebaseAutoID rebases the allocator of tp to base, or only records base if
+// the rebase is deferred.
+func (e *BaseKVEncoder) rebaseAutoID(tp autoid.AllocatorType, base int64) error {
+	if e.pendingRebases != nil {
+		if pending, ok := e.pendingRebases[tp]; !ok || base > pending {
+			e.pendingRebases[tp] = base
+		}
+		return nil
+	}
+	alloc := e.Table.Allocators(e.SessionCtx.GetTableCtx()).Get(tp)
+	return errors.Trace(alloc.Rebase(context.Background(), base, false))
+}
+
+// RebaseAutoIDs rebases the allocators to the max values recorded since the
+// last call when EncodingConfig.DeferAutoIDRebase is on, it's a no-op
+// otherwise.
+func (e *BaseKVEncoder) RebaseAutoIDs() error {
+	// use a fixed order to make the allocators behave the same on each run.
+	for _, tp := range []autoid.AllocatorType{autoid.RowIDAllocType, autoid.AutoIncrementType, autoid.AutoRandomType} {
+		base, ok := e.pendingRebases[tp]
+		if !ok {
+			continue
+		}
+		alloc := e.Table.Allocators(e.SessionCtx.GetTableCtx()).Get(tp)
+		if err := alloc.Rebase(context.Background(), base, false); err != nil {
+			return errors.Trace(err)
+		}
+		delete(e.pendingRebases, tp)
+	}
+	return nil
+}
+
 func (e *BaseKVEncoder) getActualDatum(col *table.Column, rowID int64, inputDatum *types.Datum) (types.Datum, error) {
 	var (
 		value types.Datum
@@ -271,7 +447,9 @@ func (e *BaseKVEncoder) getActualDatum(col *table.Column, rowID int64, inputDatu
 		// if MutRowFromDatums sees a nil it won't initialize the underlying storage and cause SetDatum to panic.
 		value = types.GetMinValue(&col.FieldType)
 	case isBadNullValue:
-		err = col.HandleBadNull(e.SessionCtx.Vars.StmtCtx.ErrCtx(), &value, 0)
+		err = e.handleBadNull(col, &value)
+	case e.hasDefaultOverride(col):
+		value, err = table.CastValue(e.SessionCtx, e.defaultOverrides[col.ID], col.ToInfo(), false, false)
 	default:
 		// copy from the following GetColDefaultValue function, when this is true it will use getColDefaultExprValue
 		if col.DefaultIsExpr {
@@ -286,6 +464,23 @@ func (e *BaseKVEncoder) getActualDatum(col *table.Column, rowID int64, inputDatu
 	return value, err
 }
 
+func (e *BaseKVEncoder) handleBadNull(col *table.Column, value *types.Datum) error {
+	switch e.badNullPolicies[col.ID] {
+	case encode.BadNullAsZero:
+		*value = table.GetZeroValue(col.ToInfo())
+		return nil
+	case encode.BadNullReject:
+		return col.CheckNotNull(value, 0)
+	default:
+		return col.HandleBadNull(e.SessionCtx.Vars.StmtCtx.ErrCtx(), value, 0)
+	}
+}
+
+func (e *BaseKVEncoder) hasDefaultOverride(col *table.Column) bool {
+	_, ok := e.defaultOverrides[col.ID]
+	return ok
+}
+
 // IsAutoRandomCol checks if the column is auto random column.
 func (e *BaseKVEncoder) IsAutoRandomCol(col *model.ColumnInfo) bool {
 	return e.Table.Meta().ContainsAutoRandomBits() && col.ID == e.AutoRandomColID
@@ -294,7 +489,20 @@ func (e *BaseKVEncoder) IsAutoRandomCol(col *model.ColumnInfo) bool {
 // EvalGeneratedColumns evaluates the generated columns.
 func (e *BaseKVEncoder) EvalGeneratedColumns(record []types.Datum,
 	cols []*table.Column) (errCol *model.ColumnInfo, err error) {
-	return evalGeneratedColumns(e.SessionCtx, record, cols, e.GenCols)
+	errCol, err = evalGeneratedColumns(e.SessionCtx, record, cols, e.GenCols)
+	if err != nil {
+		e.countConvertFailed(errCol)
+	}
+	return errCol, err
+}
+
+// countConvertFailed records a value which fails to be cast to the column, or
+// a generated column which fails to be evaluated, into metrics by the type of
+// the column.
+func (e *BaseKVEncoder) countConvertFailed(colInfo *model.ColumnInfo) {
+	if e.metrics != nil {
+		e.metrics.KvConvertFailedCounter.WithLabelValues(types.TypeStr(colInfo.GetType())).Inc()
+	}
 }
 
 // LogKVConvertFailed logs the error when converting a row to KV pair failed.
@@ -330,18 +538,46 @@ func (e *BaseKVEncoder) LogKVConvertFailed(row []types.Datum, j int, colInfo *mo
 }
 
 // LogEvalGenExprFailed logs the error when evaluating the generated column expression failed.
+// When the error comes from EvalGeneratedColumns, the evaluation order and the
+// columns referenced by the expression are added to the log and the returned
+// error, and the intermediate row is logged at debug level.
 func (e *BaseKVEncoder) LogEvalGenExprFailed(row []types.Datum, colInfo *model.ColumnInfo, err error) error {
+	evalErr, ok := err.(*genColEvalError)
+	if !ok {
+		e.logger.Error("kv convert failed: cannot evaluate generated column expression",
+			zap.Array("original", RowArrayMarshaller(row)),
+			zap.String("colName", colInfo.Name.O),
+			log.ShortError(err),
+		)
+
+		return errors.Annotatef(
+			err,
+			"failed to evaluate generated column expression for column `%s`",
+			colInfo.Name.O,
+		)
+	}
+
 	e.logger.Error("kv convert failed: cannot evaluate generated column expression",
 		zap.Array("original", RowArrayMarshaller(row)),
 		zap.String("colName", colInfo.Name.O),
-		log.ShortError(err),
+		zap.Int("evalOrder", evalErr.order),
+		zap.Strings("dependencies", evalErr.dependencies()),
+		zap.Strings("generatedDependencies", evalErr.generatedDependencies()),
+		log.ShortError(evalErr.err),
+	)
+	e.logger.Debug("intermediate row when evaluating generated column failed",
+		zap.String("colName", colInfo.Name.O),
+		zap.Array("row", RowArrayMarshaller(evalErr.row)),
 	)
 
-	return errors.Annotatef(
-		err,
-		"failed to evaluate generated column expression for column `%s`",
-		colInfo.Name.O,
+	msg := fmt.Sprintf(
+		"failed to evaluate generated column expression for column `%s` (evaluation order #%d",
+		colInfo.Name.O, evalErr.order,
 	)
+	if genDeps := evalErr.generatedDependencies(); len(genDeps) > 0 {
+		msg += fmt.Sprintf(", depends on generated columns %s", quoteColNames(genDeps))
+	}
+	return errors.Annotate(evalErr.err, msg+")")
 }
 
 // TruncateWarns resets the warnings in session context.
@@ -349,21 +585,89 @@ func (e *BaseKVEncoder) TruncateWarns() {
 	e.SessionCtx.Vars.StmtCtx.TruncateWarnings(0)
 }
 
+// genColEvalError is returned by evalGeneratedColumns, it records where the
+// evaluation of the generated columns failed.
+type genColEvalError struct {
+	err error
+	// order is the index of the failed column in the evaluation order.
+	order int
+	deps  []*table.Column
+	// row is the record when the evaluation failed, the generated columns
+	// before the failed one have been filled.
+	row []types.Datum
+}
+
+// Error implements the error interface.
+func (e *genColEvalError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the underlying error.
+func (e *genColEvalError) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the underlying error.
+func (e *genColEvalError) Unwrap() error {
+	return e.err
+}
+
+func (e *genColEvalError) dependencies() []string {
+	names := make([]string, 0, len(e.deps))
+	for _, col := range e.deps {
+		names = append(names, col.Name.O)
+	}
+	return names
+}
+
+func (e *genColEvalError) generatedDependencies() []string {
+	var names []string
+	for _, col := range e.deps {
+		if col.IsGenerated() {
+			names = append(names, col.Name.O)
+		}
+	}
+	return names
+}
+
+func quoteColNames(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, "`"+name+"`")
+	}
+	return strings.Join(quoted, ", ")
+}
+
 func evalGeneratedColumns(se *Session, record []types.Datum, cols []*table.Column,
 	genCols []GeneratedCol) (errCol *model.ColumnInfo, err error) {
 	mutRow := chunk.MutRowFromDatums(record)
-	for _, gc := range genCols {
+	for i, gc := range genCols {
 		col := cols[gc.Index].ToInfo()
 		evaluated, err := gc.Expr.Eval(se.GetExprCtx().GetEvalCtx(), mutRow.ToRow())
 		if err != nil {
-			return col, err
+			return col, newGenColEvalError(err, i, gc, cols, record)
 		}
 		value, err := table.CastValue(se, evaluated, col, false, false)
 		if err != nil {
-			return col, err
+			return col, newGenColEvalError(err, i, gc, cols, record)
 		}
 		mutRow.SetDatum(gc.Index, value)
 		record[gc.Index] = value
 	}
 	return nil, nil
 }
+
+func newGenColEvalError(err error, order int, gc GeneratedCol, cols []*table.Column, record []types.Datum) error {
+	var deps []*table.Column
+	for _, c := range expression.ExtractColumns(gc.Expr) {
+		if c.Index < len(cols) && !slices.Contains(deps, cols[c.Index]) {
+			deps = append(deps, cols[c.Index])
+		}
+	}
+	return &genColEvalError{
+		err:   err,
+		order: order,
+		deps:  deps,
+		row:   slices.Clone(record),
+	}
+}
@@ -22,11 +22,13 @@ import (
 
 	"github.com/pingcap/tidb/pkg/lightning/backend/encode"
 	"github.com/pingcap/tidb/pkg/lightning/log"
+	"github.com/pingcap/tidb/pkg/lightning/metric"
 	"github.com/pingcap/tidb/pkg/parser/model"
 	"github.com/pingcap/tidb/pkg/parser/mysql"
 	"github.com/pingcap/tidb/pkg/table"
 	"github.com/pingcap/tidb/pkg/table/tables"
 	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/promutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -64,8 +66,15 @@ func TestLogKVConvertFailed(t *testing.T) {
 	for i := 0; i <= 10; i++ {
 		rows = append(rows, newDatum)
 	}
+	metrics := metric.NewCommon(promutil.NewDefaultFactory(), "test", "", nil)
+	baseKVEncoder.SetMetrics(metrics)
+	// only the values which fail to cast are counted.
+	outOfRange := types.NewIntDatum(10000)
+	_, castErr := baseKVEncoder.ProcessColDatum(tbl.Cols()[0], 1, &outOfRange)
+	require.Error(t, castErr)
 	err = baseKVEncoder.LogKVConvertFailed(rows, 6, c1, err)
 	require.NoError(t, err)
+	require.Equal(t, float64(1), metric.ReadCounter(metrics.KvConvertFailedCounter.WithLabelValues("tinyint")))
 
 	var content []byte
 	content, err = os.ReadFile(tempPath)
@@ -73,3 +82,29 @@ func TestLogKVConvertFailed(t *testing.T) {
 	require.LessOrEqual(t, 500, len(string(content)))
 	require.NotContains(t, content, "exceeds maximum file size")
 }
+
+func TestShardRowID(t *testing.T) {
+	const shardRowIDBits = 3
+	idMask := int64(1)<<(64-shardRowIDBits-1) - 1
+	counts := make(map[int64]int, 1<<shardRowIDBits)
+	for id := int64(1); id <= 80000; id++ {
+		sharded := ShardRowID(456, id, shardRowIDBits)
+		require.Equal(t, sharded, ShardRowID(456, id, shardRowIDBits))
+		require.Equal(t, id, sharded&idMask)
+		require.Positive(t, sharded)
+		counts[sharded>>(64-shardRowIDBits-1)]++
+	}
+	require.Len(t, counts, 1<<shardRowIDBits)
+	for _, cnt := range counts {
+		require.InDelta(t, 10000, cnt, 500)
+	}
+
+	// the seed takes part in the shard.
+	diff := 0
+	for id := int64(1); id <= 100; id++ {
+		if ShardRowID(456, id, shardRowIDBits) != ShardRowID(457, id, shardRowIDBits) {
+			diff++
+		}
+	}
+	require.Greater(t, diff, 50)
+}
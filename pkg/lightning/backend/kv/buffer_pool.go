@@ -0,0 +1,104 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"sync"
+
+	"github.com/pingcap/tidb/pkg/types"
+)
+
+// maxPooledBufSize is the max number of byte buffers kept by a BufferPool.
+const maxPooledBufSize = 64
+
+// BufferPool is a pool of the buffers used by the KV encoders, it can be
+// shared by the encoders of different tables and chunks, so that the buffers
+// of a closed encoder are reused by the next one instead of being freed.
+//
+// The byte buffers are allocated manually, so they are kept in a bounded list
+// rather than a sync.Pool which would drop them without freeing. The record
+// slices are ordinary Go memory and use a sync.Pool.
+type BufferPool struct {
+	mu        sync.Mutex
+	bytesBufs []*BytesBuf
+	records   sync.Pool
+}
+
+// NewBufferPool creates a new BufferPool.
+func NewBufferPool() *BufferPool {
+	return &BufferPool{}
+}
+
+// getBytesBuf returns the pooled byte buffer with the smallest capacity which
+// is at least size, so the larger ones are left for larger requests. It
+// returns nil if there is no such buffer.
+func (p *BufferPool) getBytesBuf(size int) *BytesBuf {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := -1
+	for i, buf := range p.bytesBufs {
+		if buf.cap >= size && (best < 0 || buf.cap < p.bytesBufs[best].cap) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	buf := p.bytesBufs[best]
+	p.bytesBufs[best] = p.bytesBufs[len(p.bytesBufs)-1]
+	p.bytesBufs = p.bytesBufs[:len(p.bytesBufs)-1]
+	return buf
+}
+
+// putBytesBuf returns the byte buffer to the pool, the buffer is freed if the
+// pool is full.
+func (p *BufferPool) putBytesBuf(buf *BytesBuf) {
+	buf.idx = 0
+	buf.cap = len(buf.buf)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.bytesBufs) >= maxPooledBufSize {
+		buf.destroy()
+		return
+	}
+	p.bytesBufs = append(p.bytesBufs, buf)
+}
+
+// getRecord returns an empty record slice whose capacity is at least size.
+func (p *BufferPool) getRecord(size int) []types.Datum {
+	if r, ok := p.records.Get().(*[]types.Datum); ok && cap(*r) >= size {
+		return (*r)[:0]
+	}
+	return make([]types.Datum, 0, size)
+}
+
+// putRecord returns the record slice to the pool.
+func (p *BufferPool) putRecord(record []types.Datum) {
+	// clear the datums so the pool doesn't keep the row data alive.
+	clear(record[:cap(record)])
+	record = record[:0]
+	p.records.Put(&record)
+}
+
+// Destroy frees all the pooled byte buffers. The pool can't be used by any
+// encoder after it's destroyed.
+func (p *BufferPool) Destroy() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, buf := range p.bytesBufs {
+		buf.destroy()
+	}
+	p.bytesBufs = nil
+}
@@ -97,6 +97,12 @@ type MemBuf struct {
 	availableBufs []*BytesBuf
 	kvPairs       *Pairs
 	size          int
+	// if sink is set, the KV pairs are written to it directly instead of
+	// being collected into kvPairs.
+	sink KVSink
+	// if pool is set, the byte buffers are taken from and returned to it
+	// instead of being allocated and freed.
+	pool *BufferPool
 }
 
 // Recycle recycles the byte buffer.
@@ -107,7 +113,7 @@ func (mb *MemBuf) Recycle(buf *BytesBuf) {
 	if len(mb.availableBufs) >= maxAvailableBufSize {
 		// too many byte buffers, evict one byte buffer and continue
 		evictedByteBuf := mb.availableBufs[0]
-		evictedByteBuf.destroy()
+		mb.releaseBuf(evictedByteBuf)
 		mb.availableBufs = mb.availableBufs[1:]
 	}
 	mb.availableBufs = append(mb.availableBufs, buf)
@@ -133,16 +139,34 @@ func (mb *MemBuf) AllocateBuf(size int) {
 		mb.buf = existingBuf
 		mb.availableBufs[existingBufIdx] = mb.availableBufs[0]
 		mb.availableBufs = mb.availableBufs[1:]
+	} else if mb.pool != nil {
+		if mb.buf = mb.pool.getBytesBuf(size); mb.buf == nil {
+			mb.buf = newBytesBuf(size)
+		}
 	} else {
 		mb.buf = newBytesBuf(size)
 	}
 	mb.Unlock()
 }
 
+// releaseBuf returns the byte buffer to the pool if there is one, otherwise
+// frees it.
+func (mb *MemBuf) releaseBuf(buf *BytesBuf) {
+	if mb.pool != nil {
+		mb.pool.putBytesBuf(buf)
+		return
+	}
+	buf.destroy()
+}
+
 // Set sets the key-value pair.
 func (mb *MemBuf) Set(k kv.Key, v []byte) error {
 	kvPairs := mb.kvPairs
 	size := len(k) + len(v)
+	if mb.sink != nil {
+		mb.size += size
+		return mb.sink.Write(k, v)
+	}
 	if mb.buf == nil || mb.buf.cap-mb.buf.idx < size {
 		if mb.buf != nil {
 			kvPairs.BytesBuf = mb.buf
@@ -433,11 +457,11 @@ func (*Session) GetStmtStats() *stmtstats.StatementStats {
 func (se *Session) Close() {
 	memBuf := &se.txn.MemBuf
 	if memBuf.buf != nil {
-		memBuf.buf.destroy()
+		memBuf.releaseBuf(memBuf.buf)
 		memBuf.buf = nil
 	}
 	for _, b := range memBuf.availableBufs {
-		b.destroy()
+		memBuf.releaseBuf(b)
 	}
 	memBuf.availableBufs = nil
 }
@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"github.com/docker/go-units"
+	"github.com/pingcap/tidb/pkg/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -124,3 +125,56 @@ func TestKVMemBufBatchAllocAndRecycle(t *testing.T) {
 	}
 	require.Equal(t, maxAvailableBufSize, len(testKVMemBuf.availableBufs))
 }
+
+func TestKVMemBufWithBufferPool(t *testing.T) {
+	pool := NewBufferPool()
+	defer pool.Destroy()
+
+	// closing the session returns its buffers to the pool instead of freeing them.
+	se := &Session{}
+	se.txn.MemBuf.pool = pool
+	se.txn.MemBuf.AllocateBuf(1 * units.MiB)
+	buf := se.txn.MemBuf.buf
+	se.Close()
+	require.Equal(t, []*BytesBuf{buf}, pool.bytesBufs)
+
+	// a buffer large enough is taken from the pool.
+	second := &MemBuf{pool: pool}
+	second.AllocateBuf(1 * units.MiB)
+	require.Same(t, buf, second.buf)
+	require.Empty(t, pool.bytesBufs)
+
+	// a larger buffer is allocated when the pooled ones are too small.
+	second.Recycle(second.buf)
+	second.AllocateBuf(4 * units.MiB)
+	require.NotSame(t, buf, second.buf)
+	require.Equal(t, 8*units.MiB, second.buf.cap)
+	second.Recycle(second.buf)
+	for _, b := range second.availableBufs {
+		b.destroy()
+	}
+
+	// the smallest buffer large enough is taken.
+	large, small := newBytesBuf(64), newBytesBuf(32)
+	pool.putBytesBuf(large)
+	pool.putBytesBuf(small)
+	require.Nil(t, pool.getBytesBuf(100))
+	require.Same(t, small, pool.getBytesBuf(20))
+	require.Same(t, large, pool.getBytesBuf(20))
+	small.destroy()
+	large.destroy()
+
+	// the pool frees the buffers beyond its capacity.
+	for i := 0; i < maxPooledBufSize+1; i++ {
+		pool.putBytesBuf(newBytesBuf(16))
+	}
+	require.Len(t, pool.bytesBufs, maxPooledBufSize)
+
+	record := pool.getRecord(3)
+	require.Empty(t, record)
+	require.GreaterOrEqual(t, cap(record), 3)
+	pool.putRecord(append(record, types.NewIntDatum(1)))
+	record = pool.getRecord(100)
+	require.Empty(t, record)
+	require.GreaterOrEqual(t, cap(record), 100)
+}
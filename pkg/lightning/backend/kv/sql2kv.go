@@ -18,15 +18,16 @@ package kv
 
 import (
 	"cmp"
-	"context"
 	"fmt"
 	"math"
 	"slices"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/pkg/expression"
 	"github.com/pingcap/tidb/pkg/lightning/backend/encode"
 	"github.com/pingcap/tidb/pkg/lightning/common"
+	"github.com/pingcap/tidb/pkg/lightning/log"
 	"github.com/pingcap/tidb/pkg/lightning/metric"
 	"github.com/pingcap/tidb/pkg/lightning/verification"
 	"github.com/pingcap/tidb/pkg/meta/autoid"
@@ -37,11 +38,19 @@ import (
 	"github.com/pingcap/tidb/pkg/table"
 	"github.com/pingcap/tidb/pkg/tablecodec"
 	"github.com/pingcap/tidb/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type tableKVEncoder struct {
 	*BaseKVEncoder
-	metrics *metric.Metrics
+	metrics              *metric.Metrics
+	collectRowErrors     bool
+	reportGenCols        bool
+	validateRowPartition bool
+	// the observers of KvEncodeStepSecondsHistogram, they are resolved once
+	// because the steps are observed for each row. nil if metrics is nil.
+	evalGenColsObserver prometheus.Observer
+	addRecordObserver   prometheus.Observer
 }
 
 // GetSession4test is only used for test.
@@ -53,6 +62,19 @@ func GetSession4test(encoder encode.Encoder) sessionctx.Context {
 func NewTableKVEncoder(
 	config *encode.EncodingConfig,
 	metrics *metric.Metrics,
+) (encode.Encoder, error) {
+	return NewTableKVEncoderWithBufferPool(config, metrics, nil)
+}
+
+// NewTableKVEncoderWithBufferPool creates a new tableKVEncoder which takes
+// its buffers from pool, and returns them to pool when it's closed. If pool
+// is nil, it's the same as NewTableKVEncoder. The KV pairs returned by the
+// encoder must not be used after it's closed, because their memory may be
+// reused by other encoders sharing the pool.
+func NewTableKVEncoderWithBufferPool(
+	config *encode.EncodingConfig,
+	metrics *metric.Metrics,
+	pool *BufferPool,
 ) (encode.Encoder, error) {
 	if metrics != nil {
 		metrics.KvEncoderCounter.WithLabelValues("open").Inc()
@@ -61,11 +83,25 @@ func NewTableKVEncoder(
 	if err != nil {
 		return nil, err
 	}
+	if metrics != nil {
+		baseKVEncoder.SetMetrics(metrics.Common)
+	}
+	if pool != nil {
+		baseKVEncoder.setBufferPool(pool)
+	}
 
-	return &tableKVEncoder{
-		BaseKVEncoder: baseKVEncoder,
-		metrics:       metrics,
-	}, nil
+	kvcodec := &tableKVEncoder{
+		BaseKVEncoder:        baseKVEncoder,
+		metrics:              metrics,
+		collectRowErrors:     config.CollectRowErrors,
+		reportGenCols:        config.ReportGeneratedColumns,
+		validateRowPartition: config.ValidateRowPartition,
+	}
+	if metrics != nil {
+		kvcodec.evalGenColsObserver = metrics.KvEncodeStepSecondsHistogram.WithLabelValues(metric.EncodeStepEvalGenCols)
+		kvcodec.addRecordObserver = metrics.KvEncodeStepSecondsHistogram.WithLabelValues(metric.EncodeStepAddRecord)
+	}
+	return kvcodec, nil
 }
 
 // CollectGeneratedColumns collects all expressions required to evaluate the
@@ -140,7 +176,13 @@ func CollectGeneratedColumns(se *Session, meta *model.TableInfo, cols []*table.C
 
 // Close implements the Encoder interface.
 func (kvcodec *tableKVEncoder) Close() {
+	// the allocators must cover all the IDs used by the encoded rows, even if
+	// the caller doesn't flush the deferred rebases.
+	if err := kvcodec.RebaseAutoIDs(); err != nil {
+		kvcodec.logger.Error("failed to rebase auto IDs when closing the encoder", log.ShortError(err))
+	}
 	kvcodec.SessionCtx.Close()
+	kvcodec.releaseRecord()
 	if kvcodec.metrics != nil {
 		kvcodec.metrics.KvEncoderCounter.WithLabelValues("close").Inc()
 	}
@@ -151,6 +193,26 @@ type Pairs struct {
 	Pairs    []common.KvPair
 	BytesBuf *BytesBuf
 	MemBuf   *MemBuf
+
+	generated []GeneratedValue
+}
+
+// GeneratedValue is the evaluated value of a generated column.
+type GeneratedValue struct {
+	// Index is the index of the column in Table.Cols().
+	Index int
+	// Stored reports whether the column is a stored generated column, the
+	// values of virtual generated columns are only used to evaluate other
+	// generated columns and indexes, they are not in the row data.
+	Stored bool
+	Value  types.Datum
+}
+
+// GeneratedColumns returns the evaluated values of the generated columns in
+// evaluation order. It's only set when EncodingConfig.ReportGeneratedColumns
+// is on.
+func (kvs *Pairs) GeneratedColumns() []GeneratedValue {
+	return kvs.generated
 }
 
 // GroupedPairs is a map from index ID to KvPairs.
@@ -207,12 +269,18 @@ func Rows2KvPairs(rows encode.Rows) []common.KvPair {
 // back into a slice of KvPair. This method panics if the Row is not
 // constructed in such way.
 func Row2KvPairs(row encode.Row) []common.KvPair {
+	if pairs, ok := row.(*UpdatePairs); ok {
+		return pairs.Pairs.Pairs
+	}
 	return row.(*Pairs).Pairs
 }
 
 // ClearRow recycles the memory used by the row.
 func ClearRow(row encode.Row) {
-	if pairs, ok := row.(*Pairs); ok {
+	switch pairs := row.(type) {
+	case *Pairs:
+		pairs.Clear()
+	case *UpdatePairs:
 		pairs.Clear()
 	}
 }
@@ -228,8 +296,263 @@ func (kvcodec *tableKVEncoder) Encode(row []types.Datum,
 	// when generating error such as mysql.ErrDataOutOfRange, the data will be part of the error, causing the buf
 	// unable to release. So we truncate the warnings here.
 	defer kvcodec.TruncateWarns()
-	var value types.Datum
-	var err error
+
+	kvPairs, rowValue, _, err := kvcodec.encodeRow(row, rowID, columnPermutation, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := kvcodec.rebaseRowID(rowValue); err != nil {
+		return nil, err
+	}
+	return kvPairs, nil
+}
+
+// EncodeBatch encodes rows with consecutive row IDs starting from firstRowID.
+// The output is identical to calling Encode on each row, but the session and
+// the record buffer are shared by the whole batch, and the allocator of the
+// auto row ID is only rebased once at the end of the batch.
+//
+// When collectRowErrors is set, the rows with bad values are skipped and
+// their errors are returned as an encode.RowErrors, other errors still fail
+// the whole batch.
+func (kvcodec *tableKVEncoder) EncodeBatch(rows [][]types.Datum,
+	firstRowID int64, columnPermutation []int, offsets []int64) ([]encode.Row, error) {
+	if len(offsets) != len(rows) {
+		return nil, errors.Errorf("EncodeBatch got %d offsets for %d rows", len(offsets), len(rows))
+	}
+	defer kvcodec.TruncateWarns()
+
+	result := make([]encode.Row, 0, len(rows))
+	var rowErrs encode.RowErrors
+	maxRowValue := int64(math.MinInt64)
+	for i, row := range rows {
+		rowID := firstRowID + int64(i)
+		kvPairs, rowValue, badColumn, err := kvcodec.encodeRow(row, rowID, columnPermutation, nil)
+		if err != nil {
+			if badColumn != "" && kvcodec.collectRowErrors {
+				rowErrs = append(rowErrs, encode.RowError{
+					Index: i, RowID: rowID, Offset: offsets[i], Column: badColumn, Err: err,
+				})
+				continue
+			}
+			clearRows(result)
+			return nil, err
+		}
+		maxRowValue = max(maxRowValue, rowValue)
+		result = append(result, kvPairs)
+	}
+	if len(result) > 0 {
+		if err := kvcodec.rebaseRowID(maxRowValue); err != nil {
+			clearRows(result)
+			return nil, err
+		}
+	}
+	if err := kvcodec.RebaseAutoIDs(); err != nil {
+		clearRows(result)
+		return nil, err
+	}
+	if len(rowErrs) > 0 {
+		return result, rowErrs
+	}
+	return result, nil
+}
+
+// clearRows releases the buffers of rows which are dropped on error.
+func clearRows(rows []encode.Row) {
+	for _, r := range rows {
+		ClearRow(r)
+	}
+}
+
+// UpdatePairs is the result of EncodeUpdate.
+type UpdatePairs struct {
+	// Pairs are the KV pairs of the new row.
+	*Pairs
+	// Deletes are the KV pairs of the old row which don't exist in the new
+	// row, such as the index entries whose values are changed, only the keys
+	// are set. ClassifyAndAppend doesn't include them, the caller must delete
+	// them separately.
+	Deletes []common.KvPair
+
+	old *Pairs
+}
+
+// Clear implements the encode.Rows interface.
+func (p *UpdatePairs) Clear() encode.Rows {
+	p.old.Clear()
+	p.Deletes = nil
+	return p.Pairs.Clear()
+}
+
+// AutoIDRebaser is implemented by the encoder created by NewTableKVEncoder.
+type AutoIDRebaser interface {
+	// RebaseAutoIDs rebases the allocators deferred by
+	// EncodingConfig.DeferAutoIDRebase, see (*BaseKVEncoder).RebaseAutoIDs.
+	RebaseAutoIDs() error
+}
+
+// UpdateEncoder is implemented by the encoder created by NewTableKVEncoder.
+type UpdateEncoder interface {
+	// EncodeUpdate encodes the update of a row, see (*tableKVEncoder).EncodeUpdate.
+	EncodeUpdate(oldRow, newRow []types.Datum, rowID int64, columnPermutation []int) (encode.Row, error)
+}
+
+// EncodeUpdate encodes the update of a row from oldRow to newRow, which have
+// the same rowID. The returned row is an *UpdatePairs, which contains both the
+// KV pairs of the new row and the keys of the old KV pairs to be deleted, so
+// that no stale index entries are left when the update is applied.
+func (kvcodec *tableKVEncoder) EncodeUpdate(oldRow, newRow []types.Datum,
+	rowID int64, columnPermutation []int) (encode.Row, error) {
+	defer kvcodec.TruncateWarns()
+
+	oldPairs, oldRowValue, _, err := kvcodec.encodeRow(oldRow, rowID, columnPermutation, nil)
+	if err != nil {
+		return nil, err
+	}
+	newPairs, newRowValue, _, err := kvcodec.encodeRow(newRow, rowID, columnPermutation, nil)
+	if err != nil {
+		oldPairs.Clear()
+		return nil, err
+	}
+	if err := kvcodec.rebaseRowID(max(oldRowValue, newRowValue)); err != nil {
+		oldPairs.Clear()
+		newPairs.Clear()
+		return nil, err
+	}
+
+	newKeys := make(map[string]struct{}, len(newPairs.Pairs))
+	for _, pair := range newPairs.Pairs {
+		newKeys[string(pair.Key)] = struct{}{}
+	}
+	var deletes []common.KvPair
+	for _, pair := range oldPairs.Pairs {
+		if _, ok := newKeys[string(pair.Key)]; !ok {
+			deletes = append(deletes, common.KvPair{Key: pair.Key, RowID: pair.RowID})
+		}
+	}
+	return &UpdatePairs{Pairs: newPairs, Deletes: deletes, old: oldPairs}, nil
+}
+
+// PartitionEncoder is implemented by the encoder created by NewTableKVEncoder.
+type PartitionEncoder interface {
+	// EncodeToPartition encodes a row into the partition whose physical ID is
+	// partitionID, instead of letting AddRecord route the row. The caller must
+	// make sure the row belongs to that partition, it's only checked if
+	// EncodingConfig.ValidateRowPartition is set.
+	EncodeToPartition(row []types.Datum, rowID int64, columnPermutation []int, partitionID int64) (encode.Row, error)
+}
+
+// EncodeToPartition implements the PartitionEncoder interface. The partition
+// expression is not evaluated, the row is written with the key prefix of the
+// partition directly.
+func (kvcodec *tableKVEncoder) EncodeToPartition(row []types.Datum,
+	rowID int64, columnPermutation []int, partitionID int64) (encode.Row, error) {
+	defer kvcodec.TruncateWarns()
+
+	// a wrong partition is a bug of the caller rather than a bad value.
+	partition, err := kvcodec.getPartition(partitionID)
+	if err != nil {
+		return nil, err
+	}
+	kvPairs, rowValue, _, err := kvcodec.encodeRow(row, rowID, columnPermutation, partition)
+	if err != nil {
+		return nil, err
+	}
+	if err := kvcodec.rebaseRowID(rowValue); err != nil {
+		return nil, err
+	}
+	return kvPairs, nil
+}
+
+// getPartition returns the partition with the physical ID partitionID. Like
+// AddRecord of the partitioned table, it rejects a partition being truncated.
+// A partition being reorganized needs the row to be written to the new
+// partition too, which can't be done by a single partition, so it's rejected
+// while the partitions are reorganized.
+func (kvcodec *tableKVEncoder) getPartition(partitionID int64) (table.PhysicalTable, error) {
+	tblName := kvcodec.Table.Meta().Name.O
+	pt, ok := kvcodec.Table.(table.PartitionedTable)
+	if !ok {
+		return nil, errors.Errorf("table %s is not partitioned", tblName)
+	}
+	pi := kvcodec.Table.Meta().Partition
+	if pi.HasTruncatingPartitionID(partitionID) {
+		return nil, errors.Errorf("partition %d of table %s is being truncated", partitionID, tblName)
+	}
+	if len(pi.AddingDefinitions) > 0 || len(pi.DroppingDefinitions) > 0 {
+		return nil, errors.Errorf("the partitions of table %s are being reorganized", tblName)
+	}
+	partition := pt.GetPartition(partitionID)
+	if partition == nil {
+		return nil, errors.Errorf("partition %d not found in table %s", partitionID, tblName)
+	}
+	return partition, nil
+}
+
+// checkRowPartition checks the record belongs to partition, it's only called
+// when EncodingConfig.ValidateRowPartition is set.
+func (kvcodec *tableKVEncoder) checkRowPartition(record []types.Datum, partition table.PhysicalTable) error {
+	pt := kvcodec.Table.(table.PartitionedTable)
+	actual, err := pt.GetPartitionByRow(kvcodec.SessionCtx.GetExprCtx().GetEvalCtx(), record)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if actual.GetPhysicalID() != partition.GetPhysicalID() {
+		return errors.Errorf("row belongs to partition %d of table %s, not the requested partition %d",
+			actual.GetPhysicalID(), kvcodec.Table.Meta().Name.O, partition.GetPhysicalID())
+	}
+	return nil
+}
+
+// stepStartTime returns the start time of an encoding step, time.Now is only
+// called when metrics are enabled.
+func (kvcodec *tableKVEncoder) stepStartTime() time.Time {
+	if kvcodec.metrics == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (*tableKVEncoder) observeStep(observer prometheus.Observer, start time.Time) {
+	if observer == nil {
+		return
+	}
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// checkColumnPermutation checks columnPermutation has an entry for each column,
+// plus one for the _tidb_rowid column if the table has an auto row ID. The
+// _tidb_rowid entry is allowed but ignored for other tables.
+func (kvcodec *tableKVEncoder) checkColumnPermutation(columnPermutation []int) error {
+	colCnt := len(kvcodec.Columns)
+	if common.TableHasAutoRowID(kvcodec.Table.Meta()) {
+		if len(columnPermutation) != colCnt+1 {
+			return errors.Errorf("columnPermutation has %d entries, expected %d for table %s",
+				len(columnPermutation), colCnt+1, kvcodec.Table.Meta().Name.O)
+		}
+		return nil
+	}
+	if len(columnPermutation) != colCnt && len(columnPermutation) != colCnt+1 {
+		return errors.Errorf("columnPermutation has %d entries, expected %d or %d for table %s",
+			len(columnPermutation), colCnt, colCnt+1, kvcodec.Table.Meta().Name.O)
+	}
+	return nil
+}
+
+// encodeRow encodes a row into KV pairs. It also returns the value of the
+// auto row ID which the row ID allocator should be rebased to, or 0 if the
+// table has no auto row ID. If the error is caused by a value of the row
+// which can't be converted, badColumn is the name of the column of the value.
+// If partition is not nil, the row is encoded into that partition.
+func (kvcodec *tableKVEncoder) encodeRow(row []types.Datum,
+	rowID int64, columnPermutation []int, partition table.PhysicalTable) (_ *Pairs, rowValue int64, badColumn string, err error) {
+	if err := kvcodec.checkColumnPermutation(columnPermutation); err != nil {
+		return nil, 0, "", err
+	}
+	var (
+		value     types.Datum
+		generated []GeneratedValue
+	)
 
 	record := kvcodec.GetOrCreateRecord()
 	for i, col := range kvcodec.Columns {
@@ -240,14 +563,14 @@ func (kvcodec *tableKVEncoder) Encode(row []types.Datum,
 		}
 		value, err = kvcodec.ProcessColDatum(col, rowID, theDatum)
 		if err != nil {
-			return nil, kvcodec.LogKVConvertFailed(row, j, col.ToInfo(), err)
+			return nil, 0, col.Name.O, kvcodec.LogKVConvertFailed(row, j, col.ToInfo(), err)
 		}
 
 		record = append(record, value)
 	}
 
 	if common.TableHasAutoRowID(kvcodec.Table.Meta()) {
-		rowValue := rowID
+		rowValue = rowID
 		j := columnPermutation[len(kvcodec.Columns)]
 		if j >= 0 && j < len(row) {
 			value, err = table.CastValue(kvcodec.SessionCtx, row[j],
@@ -258,22 +581,67 @@ func (kvcodec *tableKVEncoder) Encode(row []types.Datum,
 			value, err = types.NewIntDatum(rowID), nil
 		}
 		if err != nil {
-			return nil, kvcodec.LogKVConvertFailed(row, j, ExtraHandleColumnInfo, err)
+			kvcodec.countConvertFailed(ExtraHandleColumnInfo)
+			return nil, 0, ExtraHandleColumnInfo.Name.O, kvcodec.LogKVConvertFailed(row, j, ExtraHandleColumnInfo, err)
 		}
 		record = append(record, value)
-		alloc := kvcodec.Table.Allocators(kvcodec.SessionCtx.GetTableCtx()).Get(autoid.RowIDAllocType)
-		if err := alloc.Rebase(context.Background(), rowValue, false); err != nil {
-			return nil, errors.Trace(err)
-		}
 	}
 
 	if len(kvcodec.GenCols) > 0 {
-		if errCol, err := kvcodec.EvalGeneratedColumns(record, kvcodec.Columns); err != nil {
-			return nil, kvcodec.LogEvalGenExprFailed(row, errCol, err)
+		start := kvcodec.stepStartTime()
+		errCol, err := kvcodec.EvalGeneratedColumns(record, kvcodec.Columns)
+		kvcodec.observeStep(kvcodec.evalGenColsObserver, start)
+		if err != nil {
+			return nil, 0, errCol.Name.O, kvcodec.LogEvalGenExprFailed(row, errCol, err)
 		}
 	}
 
-	return kvcodec.Record2KV(record, row, rowID)
+	tbl := kvcodec.Table
+	if partition != nil {
+		if kvcodec.validateRowPartition {
+			if err := kvcodec.checkRowPartition(record, partition); err != nil {
+				return nil, 0, "", err
+			}
+		}
+		tbl = partition
+	}
+	if kvcodec.reportGenCols {
+		// the record is reused by the next row, so the values are copied.
+		generated = kvcodec.generatedValues(record)
+	}
+	start := kvcodec.stepStartTime()
+	kvPairs, err := kvcodec.record2KV(tbl, record, row, rowID)
+	kvcodec.observeStep(kvcodec.addRecordObserver, start)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	kvPairs.generated = generated
+	return kvPairs, rowValue, "", nil
+}
+
+// generatedValues copies the values of the generated columns out of record.
+func (kvcodec *tableKVEncoder) generatedValues(record []types.Datum) []GeneratedValue {
+	if len(kvcodec.GenCols) == 0 {
+		return nil
+	}
+	generated := make([]GeneratedValue, 0, len(kvcodec.GenCols))
+	for _, gc := range kvcodec.GenCols {
+		v := GeneratedValue{
+			Index:  gc.Index,
+			Stored: kvcodec.Columns[gc.Index].GeneratedStored,
+		}
+		record[gc.Index].Copy(&v.Value)
+		generated = append(generated, v)
+	}
+	return generated
+}
+
+// rebaseRowID rebases the allocator of the auto row ID to rowValue.
+func (kvcodec *tableKVEncoder) rebaseRowID(rowValue int64) error {
+	if !common.TableHasAutoRowID(kvcodec.Table.Meta()) {
+		return nil
+	}
+	return kvcodec.rebaseAutoID(autoid.RowIDAllocType, rowValue)
 }
 
 // IsAutoIncCol return true if the column is auto increment column.
@@ -323,6 +691,15 @@ func (kvs *Pairs) Size() uint64 {
 	return size
 }
 
+// ChecksumContribution returns the checksum of the key-value pairs, so callers
+// can maintain a running table checksum by adding it with KVChecksum.Add while
+// encoding.
+func (kvs *Pairs) ChecksumContribution() verification.KVChecksum {
+	checksum := verification.MakeKVChecksum(0, 0, 0)
+	checksum.Update(kvs.Pairs)
+	return checksum
+}
+
 // ClassifyAndAppend separates the key-value pairs into data and index key-value pairs.
 func (kvs *Pairs) ClassifyAndAppend(
 	data *encode.Rows,
@@ -334,7 +711,7 @@ func (kvs *Pairs) ClassifyAndAppend(
 	indexKVs := (*indices).(*Pairs)
 
 	for _, kv := range kvs.Pairs {
-		if kv.Key[tablecodec.TableSplitKeyLen+1] == 'r' {
+		if tablecodec.IsRecordKey(kv.Key) {
 			dataKVs.Pairs = append(dataKVs.Pairs, kv)
 			dataChecksum.UpdateOne(kv)
 		} else {
@@ -363,5 +740,6 @@ func (kvs *Pairs) Clear() encode.Rows {
 		kvs.MemBuf = nil
 	}
 	kvs.Pairs = kvs.Pairs[:0]
+	kvs.generated = nil
 	return kvs
 }
@@ -15,10 +15,14 @@
 package kv_test
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pingcap/tidb/pkg/ddl"
 	"github.com/pingcap/tidb/pkg/kv"
@@ -26,6 +30,7 @@ import (
 	lkv "github.com/pingcap/tidb/pkg/lightning/backend/kv"
 	"github.com/pingcap/tidb/pkg/lightning/common"
 	"github.com/pingcap/tidb/pkg/lightning/log"
+	"github.com/pingcap/tidb/pkg/lightning/metric"
 	"github.com/pingcap/tidb/pkg/lightning/verification"
 	"github.com/pingcap/tidb/pkg/meta/autoid"
 	"github.com/pingcap/tidb/pkg/parser"
@@ -38,6 +43,8 @@ import (
 	"github.com/pingcap/tidb/pkg/tablecodec"
 	"github.com/pingcap/tidb/pkg/types"
 	"github.com/pingcap/tidb/pkg/util/mock"
+	"github.com/pingcap/tidb/pkg/util/promutil"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -60,11 +67,38 @@ func TestMarshal(t *testing.T) {
 
 	invalid := types.Datum{}
 	invalid.SetInterface(1)
-	err = encoder.AddArray("bad-test", lkv.RowArrayMarshaller{minNotNull, invalid})
-	require.Regexp(t, "cannot convert.*", err)
+	err = encoder.AddArray("bad-test", lkv.RowArrayMarshaller{minNotNull, invalid, types.NewStringDatum("2")})
+	require.NoError(t, err)
 	require.Equal(t, encoder.Fields["bad-test"], []any{
 		map[string]any{"kind": "min", "val": "-inf"},
+		map[string]any{"kind": "interface", "val": "(unprintable interface value: cannot convert 1(type int) to string)"},
+		map[string]any{"kind": "string", "val": "2"},
 	})
+
+	j, err := types.ParseBinaryJSONFromString(`{"a": [1, "b"]}`)
+	require.NoError(t, err)
+	longJSON := types.CreateBinaryJSON(strings.Repeat("x", 4096))
+	datetime := types.NewTime(types.FromDate(2024, 1, 2, 3, 4, 5, 0), mysql.TypeDatetime, 0)
+	date := types.NewTime(types.FromDate(2024, 1, 2, 0, 0, 0, 0), mysql.TypeDate, 0)
+	duration := types.Duration{Duration: time.Hour + 2*time.Minute, Fsp: 0}
+	err = encoder.AddArray("typed-test", lkv.RowArrayMarshaller{
+		types.NewJSONDatum(j),
+		types.NewJSONDatum(longJSON),
+		types.NewTimeDatum(datetime),
+		types.NewTimeDatum(date),
+		types.NewDurationDatum(duration),
+	})
+	require.NoError(t, err)
+	fields := encoder.Fields["typed-test"].([]any)
+	require.Len(t, fields, 5)
+	require.Equal(t, map[string]any{"kind": "json", "val": `{"a": [1, "b"]}`}, fields[0])
+	truncated := fields[1].(map[string]any)["val"].(string)
+	require.True(t, json.Valid([]byte(truncated)), truncated)
+	require.Less(t, len(truncated), 2048)
+	require.True(t, strings.HasSuffix(truncated, `... (truncated)"`), truncated)
+	require.Equal(t, map[string]any{"kind": "time", "val": "DATETIME '2024-01-02 03:04:05'"}, fields[2])
+	require.Equal(t, map[string]any{"kind": "time", "val": "DATE '2024-01-02'"}, fields[3])
+	require.Equal(t, map[string]any{"kind": "duration", "val": "TIME '01:02:00'"}, fields[4])
 }
 
 type mockTable struct {
@@ -158,6 +192,168 @@ func TestEncode(t *testing.T) {
 	}))
 }
 
+func TestEncodeConvertFailedMetric(t *testing.T) {
+	c1 := &model.ColumnInfo{ID: 1, Name: model.NewCIStr("c1"), State: model.StatePublic, Offset: 0, FieldType: *types.NewFieldType(mysql.TypeDatetime)}
+	cols := []*model.ColumnInfo{c1}
+	tblInfo := &model.TableInfo{ID: 1, Columns: cols, PKIsHandle: false, State: model.StatePublic}
+	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+
+	metrics := metric.NewMetrics(promutil.NewDefaultFactory())
+	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table: tbl,
+		SessionOptions: encode.SessionOptions{
+			SQLMode:   mysql.ModeStrictAllTables,
+			Timestamp: 1234567890,
+		},
+		Logger: log.Logger{Logger: zap.NewNop()},
+	}, metrics)
+	require.NoError(t, err)
+
+	_, err = encoder.Encode([]types.Datum{types.NewStringDatum("not-a-datetime")}, 1, []int{0, -1}, 1234)
+	require.Error(t, err)
+	require.Equal(t, float64(1), metric.ReadCounter(metrics.KvConvertFailedCounter.WithLabelValues("datetime")))
+
+	_, err = encoder.Encode([]types.Datum{types.NewStringDatum("2024-01-01 00:00:00"), types.NewStringDatum("invalid-pk")}, 2, []int{0, 1}, 1234)
+	require.Error(t, err)
+	require.Equal(t, float64(1), metric.ReadCounter(metrics.KvConvertFailedCounter.WithLabelValues("datetime")))
+	require.Equal(t, float64(1), metric.ReadCounter(metrics.KvConvertFailedCounter.WithLabelValues("bigint")))
+
+	_, err = encoder.Encode([]types.Datum{types.NewStringDatum("2024-01-01 00:00:00")}, 3, []int{0, -1}, 1234)
+	require.NoError(t, err)
+	require.Equal(t, float64(1), metric.ReadCounter(metrics.KvConvertFailedCounter.WithLabelValues("datetime")))
+}
+
+func TestEncodeStepMetrics(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (a int, b int as (a + 1) stored);")
+	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+	metrics := metric.NewMetrics(promutil.NewDefaultFactory())
+	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table:  tbl,
+		Logger: log.L(),
+	}, metrics)
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		_, err = encoder.Encode([]types.Datum{types.NewIntDatum(int64(i))}, int64(i), []int{0, -1, -1}, 0)
+		require.NoError(t, err)
+	}
+	for _, step := range []string{metric.EncodeStepEvalGenCols, metric.EncodeStepAddRecord} {
+		histogram := metrics.KvEncodeStepSecondsHistogram.WithLabelValues(step).(prometheus.Histogram)
+		require.Equal(t, uint64(3), *metric.ReadHistogram(histogram).Histogram.SampleCount, step)
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	c1 := &model.ColumnInfo{ID: 1, Name: model.NewCIStr("c1"), State: model.StatePublic, Offset: 0, FieldType: *types.NewFieldType(mysql.TypeLong)}
+	c1.AddFlag(mysql.NotNullFlag)
+	idx := &model.IndexInfo{ID: 1, Name: model.NewCIStr("idx"), State: model.StatePublic, Columns: []*model.IndexColumn{{Name: c1.Name, Offset: 0, Length: types.UnspecifiedLength}}}
+	tblInfo := &model.TableInfo{ID: 1, Columns: []*model.ColumnInfo{c1}, Indices: []*model.IndexInfo{idx}, PKIsHandle: false, State: model.StatePublic}
+
+	newEncoder := func() (encode.Encoder, table.Table) {
+		tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+		require.NoError(t, err)
+		encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+			Table: tbl,
+			SessionOptions: encode.SessionOptions{
+				SQLMode:   mysql.ModeStrictAllTables,
+				Timestamp: 1234567890,
+			},
+			Logger: log.L(),
+		}, nil)
+		require.NoError(t, err)
+		return encoder, tbl
+	}
+
+	rows := [][]types.Datum{
+		{types.NewIntDatum(1), types.NewStringDatum("10")},
+		{types.NewIntDatum(2), types.NewStringDatum("3")},
+		{types.NewIntDatum(3), types.NewStringDatum("7")},
+	}
+	colPerm := []int{0, 1}
+
+	encoder, tbl := newEncoder()
+	expected := make([]encode.Row, 0, len(rows))
+	for i, row := range rows {
+		pairs, err := encoder.Encode(row, int64(i+1), colPerm, 0)
+		require.NoError(t, err)
+		expected = append(expected, pairs)
+	}
+	expectedBase := tbl.Allocators(lkv.GetSession4test(encoder).GetTableCtx()).Get(autoid.RowIDAllocType).Base()
+	require.Equal(t, int64(10), expectedBase)
+
+	batchEncoder, batchTbl := newEncoder()
+	actual, err := batchEncoder.EncodeBatch(rows, 1, colPerm, []int64{0, 0, 0})
+	require.NoError(t, err)
+	require.Len(t, actual, len(expected))
+	for i := range expected {
+		require.Equal(t, lkv.Row2KvPairs(expected[i]), lkv.Row2KvPairs(actual[i]))
+	}
+	require.Equal(t, expectedBase, batchTbl.Allocators(lkv.GetSession4test(batchEncoder).GetTableCtx()).Get(autoid.RowIDAllocType).Base())
+
+	// an error in the middle of the batch fails the whole batch.
+	badRows := [][]types.Datum{
+		{types.NewIntDatum(4), types.NewStringDatum("20")},
+		{types.NewStringDatum("invalid"), types.NewStringDatum("21")},
+	}
+	actual, err = batchEncoder.EncodeBatch(badRows, 4, colPerm, []int64{0, 0})
+	require.Regexp(t, "failed to cast value as int\\(11\\) for column `c1` \\(#1\\)", err)
+	require.Nil(t, actual)
+	// the offsets must match the rows.
+	actual, err = batchEncoder.EncodeBatch(rows, 1, colPerm, []int64{0})
+	require.ErrorContains(t, err, "EncodeBatch got 1 offsets for 3 rows")
+	require.Nil(t, actual)
+}
+
+func TestEncodeBatchCollectRowErrors(t *testing.T) {
+	c1 := &model.ColumnInfo{ID: 1, Name: model.NewCIStr("c1"), State: model.StatePublic, Offset: 0, FieldType: *types.NewFieldType(mysql.TypeTiny)}
+	c2 := &model.ColumnInfo{ID: 2, Name: model.NewCIStr("c2"), State: model.StatePublic, Offset: 1, FieldType: *types.NewFieldType(mysql.TypeDatetime)}
+	tblInfo := &model.TableInfo{ID: 1, Columns: []*model.ColumnInfo{c1, c2}, PKIsHandle: false, State: model.StatePublic}
+	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table: tbl,
+		SessionOptions: encode.SessionOptions{
+			SQLMode:   mysql.ModeStrictAllTables,
+			Timestamp: 1234567890,
+		},
+		Logger:           log.Logger{Logger: zap.NewNop()},
+		CollectRowErrors: true,
+	}, nil)
+	require.NoError(t, err)
+
+	rows := [][]types.Datum{
+		{types.NewIntDatum(1), types.NewStringDatum("2024-01-01 00:00:00")},
+		{types.NewIntDatum(10000), types.NewStringDatum("2024-01-01 00:00:00")},
+		{types.NewIntDatum(3), types.NewStringDatum("2024-01-01 00:00:00")},
+		{types.NewIntDatum(4), types.NewStringDatum("not-a-datetime")},
+	}
+	encoded, err := encoder.EncodeBatch(rows, 1, []int{0, 1, -1}, []int64{10, 20, 30, 40})
+	require.Len(t, encoded, 2)
+	_, h, err2 := tablecodec.DecodeRecordKey(lkv.Row2KvPairs(encoded[0])[0].Key)
+	require.NoError(t, err2)
+	require.Equal(t, int64(1), h.IntValue())
+	_, h, err2 = tablecodec.DecodeRecordKey(lkv.Row2KvPairs(encoded[1])[0].Key)
+	require.NoError(t, err2)
+	require.Equal(t, int64(3), h.IntValue())
+
+	var rowErrs encode.RowErrors
+	require.ErrorAs(t, err, &rowErrs)
+	require.Len(t, rowErrs, 2)
+	require.Equal(t, 1, rowErrs[0].Index)
+	require.Equal(t, int64(2), rowErrs[0].RowID)
+	require.Equal(t, int64(20), rowErrs[0].Offset)
+	require.Equal(t, "c1", rowErrs[0].Column)
+	require.ErrorContains(t, rowErrs[0].Err, "for column `c1` (#1)")
+	require.Equal(t, 3, rowErrs[1].Index)
+	require.Equal(t, int64(4), rowErrs[1].RowID)
+	require.Equal(t, int64(40), rowErrs[1].Offset)
+	require.Equal(t, "c2", rowErrs[1].Column)
+	require.ErrorContains(t, rowErrs[1].Err, "for column `c2` (#2)")
+	require.ErrorContains(t, err, "2 rows failed to encode; row 1 (rowID 2, offset 20, column c1): ")
+}
+
 func TestDecode(t *testing.T) {
 	c1 := &model.ColumnInfo{ID: 1, Name: model.NewCIStr("c1"), State: model.StatePublic, Offset: 0, FieldType: *types.NewFieldType(mysql.TypeTiny)}
 	cols := []*model.ColumnInfo{c1}
@@ -387,6 +583,54 @@ func TestEncodeDoubleAutoIncrement(t *testing.T) {
 	require.Equal(t, tbl.Allocators(lkv.GetEncoderSe(encoder).GetTableCtx()).Get(autoid.AutoIncrementType).Base(), int64(70))
 }
 
+func TestEncodeDeferAutoIDRebase(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (id bigint primary key auto_increment, v int);")
+	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table: tbl,
+		SessionOptions: encode.SessionOptions{
+			SQLMode: mysql.ModeStrictAllTables,
+		},
+		Logger:            log.L(),
+		DeferAutoIDRebase: true,
+	}, nil)
+	require.NoError(t, err)
+	alloc := tbl.Allocators(lkv.GetEncoderSe(encoder).GetTableCtx()).Get(autoid.AutoIncrementType)
+	rebaser := encoder.(lkv.AutoIDRebaser)
+
+	// the ids are out of order, the allocator must end up at the max one.
+	for i, id := range []int64{5, 100, 3} {
+		_, err = encoder.Encode([]types.Datum{types.NewIntDatum(id), types.NewIntDatum(1)}, int64(i+1), []int{0, 1, -1}, 0)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(0), alloc.Base())
+	require.NoError(t, rebaser.RebaseAutoIDs())
+	require.Equal(t, int64(100), alloc.Base())
+
+	// a smaller value never moves the allocator back.
+	_, err = encoder.Encode([]types.Datum{types.NewIntDatum(50), types.NewIntDatum(1)}, 4, []int{0, 1, -1}, 0)
+	require.NoError(t, err)
+	require.NoError(t, rebaser.RebaseAutoIDs())
+	require.Equal(t, int64(100), alloc.Base())
+
+	// EncodeBatch rebases once at the end of the batch.
+	_, err = encoder.EncodeBatch([][]types.Datum{
+		{types.NewIntDatum(7), types.NewIntDatum(1)},
+		{types.NewIntDatum(300), types.NewIntDatum(1)},
+		{types.NewIntDatum(150), types.NewIntDatum(1)},
+	}, 5, []int{0, 1, -1}, []int64{0, 0, 0})
+	require.NoError(t, err)
+	require.Equal(t, int64(300), alloc.Base())
+
+	// the rebases not flushed by the caller are flushed when closing.
+	_, err = encoder.Encode([]types.Datum{types.NewIntDatum(500), types.NewIntDatum(1)}, 8, []int{0, 1, -1}, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(300), alloc.Base())
+	encoder.Close()
+	require.Equal(t, int64(500), alloc.Base())
+}
+
 func TestEncodeMissingAutoValue(t *testing.T) {
 	var rowID int64 = 70
 	type testTableInfo struct {
@@ -455,6 +699,96 @@ func TestEncodeMissingAutoValue(t *testing.T) {
 	}
 }
 
+func TestEncodeDefaultValueOverrides(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (id int primary key auto_increment, tenant_id int default 1, b int, c int as (b + 1) stored);")
+	newConfig := func(overrides map[string]types.Datum) *encode.EncodingConfig {
+		tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+		require.NoError(t, err)
+		return &encode.EncodingConfig{
+			Table: tbl,
+			SessionOptions: encode.SessionOptions{
+				SQLMode: mysql.ModeStrictAllTables,
+			},
+			Logger:                log.L(),
+			DefaultValueOverrides: overrides,
+		}
+	}
+
+	encoder, err := lkv.NewTableKVEncoder(newConfig(map[string]types.Datum{
+		"Tenant_ID": types.NewStringDatum("42"),
+	}), nil)
+	require.NoError(t, err)
+	plainEncoder, err := lkv.NewTableKVEncoder(newConfig(nil), nil)
+	require.NoError(t, err)
+
+	// tenant_id is missing from the source row, the override is used.
+	pairs, err := encoder.Encode([]types.Datum{types.NewIntDatum(1), types.NewIntDatum(2)}, 1, []int{0, -1, 1, -1, -1}, 0)
+	require.NoError(t, err)
+	pairsExpect, err := plainEncoder.Encode([]types.Datum{types.NewIntDatum(1), types.NewIntDatum(42), types.NewIntDatum(2)}, 1, []int{0, 1, 2, -1, -1}, 0)
+	require.NoError(t, err)
+	require.Equal(t, lkv.Row2KvPairs(pairsExpect), lkv.Row2KvPairs(pairs))
+
+	// the value in the source row takes precedence over the override.
+	pairs, err = encoder.Encode([]types.Datum{types.NewIntDatum(1), types.NewIntDatum(7), types.NewIntDatum(2)}, 1, []int{0, 1, 2, -1, -1}, 0)
+	require.NoError(t, err)
+	pairsExpect, err = plainEncoder.Encode([]types.Datum{types.NewIntDatum(1), types.NewIntDatum(7), types.NewIntDatum(2)}, 1, []int{0, 1, 2, -1, -1}, 0)
+	require.NoError(t, err)
+	require.Equal(t, lkv.Row2KvPairs(pairsExpect), lkv.Row2KvPairs(pairs))
+
+	_, err = lkv.NewTableKVEncoder(newConfig(map[string]types.Datum{"id": types.NewIntDatum(1)}), nil)
+	require.ErrorContains(t, err, "can't override the default value of generated or auto-id column id")
+	_, err = lkv.NewTableKVEncoder(newConfig(map[string]types.Datum{"c": types.NewIntDatum(1)}), nil)
+	require.ErrorContains(t, err, "can't override the default value of generated or auto-id column c")
+	_, err = lkv.NewTableKVEncoder(newConfig(map[string]types.Datum{"d": types.NewIntDatum(1)}), nil)
+	require.ErrorContains(t, err, "unknown column d in default value overrides")
+}
+
+func TestEncodeBadNullPolicies(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (a int not null, b int not null, c int not null);")
+	newEncoder := func(sqlMode mysql.SQLMode) encode.Encoder {
+		tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+		require.NoError(t, err)
+		encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+			Table: tbl,
+			SessionOptions: encode.SessionOptions{
+				SQLMode: sqlMode,
+			},
+			BadNullPolicies: map[string]encode.BadNullPolicy{
+				"a": encode.BadNullAsZero,
+				"b": encode.BadNullReject,
+			},
+			Logger: log.L(),
+		}, nil)
+		require.NoError(t, err)
+		return encoder
+	}
+	var nullDatum types.Datum
+	nullDatum.SetNull()
+	colPerm := []int{0, 1, 2, -1}
+	zeroRow := []types.Datum{types.NewIntDatum(0), types.NewIntDatum(0), types.NewIntDatum(0)}
+
+	for _, sqlMode := range []mysql.SQLMode{mysql.ModeStrictAllTables, mysql.ModeNone} {
+		encoder := newEncoder(sqlMode)
+		pairsExpect, err := encoder.Encode(zeroRow, 1, colPerm, 0)
+		require.NoError(t, err)
+		pairs, err := encoder.Encode([]types.Datum{nullDatum, types.NewIntDatum(0), types.NewIntDatum(0)}, 1, colPerm, 0)
+		require.NoError(t, err)
+		require.Equal(t, lkv.Row2KvPairs(pairsExpect), lkv.Row2KvPairs(pairs))
+
+		_, err = encoder.Encode([]types.Datum{types.NewIntDatum(0), nullDatum, types.NewIntDatum(0)}, 1, colPerm, 0)
+		require.ErrorContains(t, err, "Column 'b' cannot be null")
+
+		// c follows the SQL mode.
+		pairs, err = encoder.Encode([]types.Datum{types.NewIntDatum(0), types.NewIntDatum(0), nullDatum}, 1, colPerm, 0)
+		if sqlMode == mysql.ModeNone {
+			require.NoError(t, err)
+			require.Equal(t, lkv.Row2KvPairs(pairsExpect), lkv.Row2KvPairs(pairs))
+		} else {
+			require.ErrorContains(t, err, "Column 'c' cannot be null")
+		}
+	}
+}
+
 func TestEncodeExpressionColumn(t *testing.T) {
 	tblInfo := mockTableInfo(t, "create table t (id varchar(40) not null DEFAULT uuid(), unique key `u_id` (`id`));")
 	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
@@ -500,6 +834,232 @@ func mockTableInfo(t *testing.T, createSQL string) *model.TableInfo {
 	return info
 }
 
+func TestEvalGeneratedColumnsError(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (a bigint, b bigint as (a * 2), c tinyint as (b + a) stored);")
+	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table: tbl,
+		SessionOptions: encode.SessionOptions{
+			SQLMode: mysql.ModeStrictAllTables,
+		},
+		Logger: log.L(),
+	}, nil)
+	require.NoError(t, err)
+
+	_, err = encoder.Encode([]types.Datum{types.NewIntDatum(1)}, 1, []int{0, -1, -1, -1}, 0)
+	require.NoError(t, err)
+
+	// c overflows tinyint, the error tells it depends on the generated column b.
+	_, err = encoder.Encode([]types.Datum{types.NewIntDatum(100)}, 2, []int{0, -1, -1, -1}, 0)
+	require.ErrorContains(t, err, "failed to evaluate generated column expression for column `c` (evaluation order #1, depends on generated columns `b`)")
+}
+
+func TestEncodeReportGeneratedColumns(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (a bigint, b bigint as (a * 2), c varchar(10) as (concat(b, 'x')) stored);")
+	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+	newEncoder := func(report bool) encode.Encoder {
+		encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+			Table: tbl,
+			SessionOptions: encode.SessionOptions{
+				SQLMode: mysql.ModeStrictAllTables,
+			},
+			Logger:                 log.L(),
+			ReportGeneratedColumns: report,
+		}, nil)
+		require.NoError(t, err)
+		return encoder
+	}
+
+	encoder := newEncoder(true)
+	row1, err := encoder.Encode([]types.Datum{types.NewIntDatum(1)}, 1, []int{0, -1, -1, -1}, 0)
+	require.NoError(t, err)
+	row2, err := encoder.Encode([]types.Datum{types.NewIntDatum(5)}, 2, []int{0, -1, -1, -1}, 0)
+	require.NoError(t, err)
+	checkGenerated := func(row encode.Row, b int64, c string) {
+		generated := row.(*lkv.Pairs).GeneratedColumns()
+		require.Len(t, generated, 2)
+		require.Equal(t, 1, generated[0].Index)
+		require.False(t, generated[0].Stored)
+		require.Equal(t, b, generated[0].Value.GetInt64())
+		require.Equal(t, 2, generated[1].Index)
+		require.True(t, generated[1].Stored)
+		require.Equal(t, c, generated[1].Value.GetString())
+	}
+	// the values of the first row are not overwritten by the second one.
+	checkGenerated(row1, 2, "2x")
+	checkGenerated(row2, 10, "10x")
+
+	// the KV pairs are the same as the ones encoded without reporting.
+	plain, err := newEncoder(false).Encode([]types.Datum{types.NewIntDatum(1)}, 1, []int{0, -1, -1, -1}, 0)
+	require.NoError(t, err)
+	require.Nil(t, plain.(*lkv.Pairs).GeneratedColumns())
+	require.Equal(t, lkv.Row2KvPairs(plain), lkv.Row2KvPairs(row1))
+
+	lkv.ClearRow(row1)
+	require.Nil(t, row1.(*lkv.Pairs).GeneratedColumns())
+}
+
+func TestEncodeToPartition(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (a int, b int, key idx_b(b));")
+	tblInfo.Partition = &model.PartitionInfo{
+		Type:   model.PartitionTypeRange,
+		Expr:   "`a`",
+		Enable: true,
+		Definitions: []model.PartitionDefinition{
+			{ID: 11, Name: model.NewCIStr("p0"), LessThan: []string{"10"}},
+			{ID: 12, Name: model.NewCIStr("p1"), LessThan: []string{"MAXVALUE"}},
+		},
+	}
+	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table: tbl,
+		SessionOptions: encode.SessionOptions{
+			SQLMode: mysql.ModeStrictAllTables,
+		},
+		Logger: log.L(),
+	}, nil)
+	require.NoError(t, err)
+	partEncoder := encoder.(lkv.PartitionEncoder)
+
+	row := []types.Datum{types.NewIntDatum(15), types.NewIntDatum(1)}
+	colPerm := []int{0, 1, -1}
+	pairsExpect, err := encoder.Encode(row, 1, colPerm, 0)
+	require.NoError(t, err)
+	pairs, err := partEncoder.EncodeToPartition(row, 1, colPerm, 12)
+	require.NoError(t, err)
+	require.Equal(t, lkv.Row2KvPairs(pairsExpect), lkv.Row2KvPairs(pairs))
+	for _, pair := range lkv.Row2KvPairs(pairs) {
+		require.Equal(t, int64(12), tablecodec.DecodeTableID(pair.Key))
+	}
+
+	// the partition of the row is trusted by default.
+	pairs, err = partEncoder.EncodeToPartition(row, 2, colPerm, 11)
+	require.NoError(t, err)
+	for _, pair := range lkv.Row2KvPairs(pairs) {
+		require.Equal(t, int64(11), tablecodec.DecodeTableID(pair.Key))
+	}
+	validateEncoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table: tbl,
+		SessionOptions: encode.SessionOptions{
+			SQLMode: mysql.ModeStrictAllTables,
+		},
+		Logger:               log.L(),
+		ValidateRowPartition: true,
+	}, nil)
+	require.NoError(t, err)
+	_, err = validateEncoder.(lkv.PartitionEncoder).EncodeToPartition(row, 2, colPerm, 12)
+	require.NoError(t, err)
+	_, err = validateEncoder.(lkv.PartitionEncoder).EncodeToPartition(row, 2, colPerm, 11)
+	require.ErrorContains(t, err, "row belongs to partition 12 of table t, not the requested partition 11")
+	_, err = partEncoder.EncodeToPartition(row, 2, colPerm, 13)
+	require.ErrorContains(t, err, "partition 13 not found in table t")
+
+	// the partitions under DDL are rejected like AddRecord.
+	tblInfo.Partition.NewPartitionIDs = []int64{12}
+	_, err = partEncoder.EncodeToPartition(row, 2, colPerm, 12)
+	require.ErrorContains(t, err, "partition 12 of table t is being truncated")
+	tblInfo.Partition.NewPartitionIDs = nil
+	tblInfo.Partition.DroppingDefinitions = tblInfo.Partition.Definitions[1:]
+	_, err = partEncoder.EncodeToPartition(row, 2, colPerm, 12)
+	require.ErrorContains(t, err, "the partitions of table t are being reorganized")
+	tblInfo.Partition.DroppingDefinitions = nil
+
+	tblInfo = mockTableInfo(t, "create table t (a int, b int);")
+	tbl, err = tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+	encoder, err = lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table:  tbl,
+		Logger: log.L(),
+	}, nil)
+	require.NoError(t, err)
+	_, err = encoder.(lkv.PartitionEncoder).EncodeToPartition(row, 1, colPerm, 12)
+	require.ErrorContains(t, err, "table t is not partitioned")
+}
+
+func TestEncodeUpdate(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (a int primary key, b int, c int, key idx_b(b), key idx_c(c));")
+	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table: tbl,
+		SessionOptions: encode.SessionOptions{
+			SQLMode: mysql.ModeStrictAllTables,
+		},
+		Logger: log.L(),
+	}, nil)
+	require.NoError(t, err)
+
+	oldRow := []types.Datum{types.NewIntDatum(1), types.NewIntDatum(2), types.NewIntDatum(3)}
+	newRow := []types.Datum{types.NewIntDatum(1), types.NewIntDatum(5), types.NewIntDatum(3)}
+	colPerm := []int{0, 1, 2, -1}
+	row, err := encoder.(lkv.UpdateEncoder).EncodeUpdate(oldRow, newRow, 1, colPerm)
+	require.NoError(t, err)
+	update := row.(*lkv.UpdatePairs)
+
+	pairsExpect, err := encoder.Encode(newRow, 1, colPerm, 0)
+	require.NoError(t, err)
+	require.Equal(t, lkv.Row2KvPairs(pairsExpect), lkv.Row2KvPairs(update))
+
+	// only the entry of idx_b is changed.
+	require.Len(t, update.Deletes, 1)
+	_, indexID, isRecordKey, err := tablecodec.DecodeKeyHead(update.Deletes[0].Key)
+	require.NoError(t, err)
+	require.False(t, isRecordKey)
+	require.Equal(t, tblInfo.FindIndexByName("idx_b").ID, indexID)
+	oldPairs, err := encoder.Encode(oldRow, 1, colPerm, 0)
+	require.NoError(t, err)
+	oldKeys := make([][]byte, 0, 3)
+	for _, pair := range lkv.Row2KvPairs(oldPairs) {
+		oldKeys = append(oldKeys, pair.Key)
+	}
+	require.Contains(t, oldKeys, update.Deletes[0].Key)
+	lkv.ClearRow(update)
+
+	// the record key is deleted too when the primary key is changed.
+	newRow[0] = types.NewIntDatum(10)
+	row, err = encoder.(lkv.UpdateEncoder).EncodeUpdate(oldRow, newRow, 1, colPerm)
+	require.NoError(t, err)
+	require.Len(t, row.(*lkv.UpdatePairs).Deletes, 3)
+}
+
+func TestEncodeColumnPermutationLength(t *testing.T) {
+	newEncoder := func(createSQL string) encode.Encoder {
+		tblInfo := mockTableInfo(t, createSQL)
+		tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+		require.NoError(t, err)
+		encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+			Table:  tbl,
+			Logger: log.L(),
+		}, nil)
+		require.NoError(t, err)
+		return encoder
+	}
+	row := []types.Datum{types.NewIntDatum(1), types.NewIntDatum(2)}
+
+	// the table has an auto row ID, the _tidb_rowid entry is required.
+	encoder := newEncoder("create table t (a int, b int);")
+	_, err := encoder.Encode(row, 1, []int{0, 1, -1}, 0)
+	require.NoError(t, err)
+	_, err = encoder.Encode(row, 2, []int{0, 1}, 0)
+	require.ErrorContains(t, err, "columnPermutation has 2 entries, expected 3 for table t")
+	_, err = encoder.Encode(row, 3, []int{0, 1, -1, -1}, 0)
+	require.ErrorContains(t, err, "columnPermutation has 4 entries, expected 3 for table t")
+
+	// the _tidb_rowid entry is optional.
+	encoder = newEncoder("create table t (a int primary key, b int);")
+	_, err = encoder.Encode(row, 1, []int{0, 1}, 0)
+	require.NoError(t, err)
+	_, err = encoder.Encode(row, 1, []int{0, 1, -1}, 0)
+	require.NoError(t, err)
+	_, err = encoder.Encode(row, 1, []int{0}, 0)
+	require.ErrorContains(t, err, "columnPermutation has 1 entries, expected 2 or 3 for table t")
+	_, err = encoder.Encode(row, 1, []int{0, 1, -1, -1}, 0)
+	require.ErrorContains(t, err, "columnPermutation has 4 entries, expected 2 or 3 for table t")
+}
+
 func TestDefaultAutoRandoms(t *testing.T) {
 	tblInfo := mockTableInfo(t, "create table t (id bigint unsigned NOT NULL auto_random primary key clustered, a varchar(100));")
 	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
@@ -540,33 +1100,43 @@ func TestDefaultAutoRandoms(t *testing.T) {
 
 func TestShardRowId(t *testing.T) {
 	tblInfo := mockTableInfo(t, "create table t (s varchar(16)) shard_row_id_bits = 3;")
-	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
-	require.NoError(t, err)
-	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
-		Table: tbl,
-		SessionOptions: encode.SessionOptions{
-			SQLMode:        mysql.ModeStrictAllTables,
-			Timestamp:      1234567893,
-			SysVars:        map[string]string{"tidb_row_format_version": "2"},
-			AutoRandomSeed: 456,
-		},
-		Logger: log.L(),
-	}, nil)
-	require.NoError(t, err)
-	keyMap := make(map[int64]struct{}, 16)
-	for i := int64(1); i <= 32; i++ {
-		pairs, err := encoder.Encode([]types.Datum{types.NewStringDatum(fmt.Sprintf("%d", i))}, i, []int{0, -1}, i*32)
+	for _, deterministic := range []bool{false, true} {
+		tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
 		require.NoError(t, err)
-		kvs := fromRow(pairs)
-		require.Len(t, kvs.pairs, 1)
-		_, h, err := tablecodec.DecodeRecordKey(kvs.pairs[0].Key)
+		encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+			Table: tbl,
+			SessionOptions: encode.SessionOptions{
+				SQLMode:        mysql.ModeStrictAllTables,
+				Timestamp:      1234567893,
+				SysVars:        map[string]string{"tidb_row_format_version": "2"},
+				AutoRandomSeed: 456,
+			},
+			Logger:                  log.L(),
+			DeterministicShardRowID: deterministic,
+		}, nil)
 		require.NoError(t, err)
-		rowID := h.IntValue()
-		require.Equal(t, rowID&((1<<60)-1), i)
-		keyMap[rowID>>60] = struct{}{}
+		keyMap := make(map[int64]struct{}, 16)
+		for i := int64(1); i <= 32; i++ {
+			pairs, err := encoder.Encode([]types.Datum{types.NewStringDatum(fmt.Sprintf("%d", i))}, i, []int{0, -1}, i*32)
+			require.NoError(t, err)
+			kvs := fromRow(pairs)
+			require.Len(t, kvs.pairs, 1)
+			_, h, err := tablecodec.DecodeRecordKey(kvs.pairs[0].Key)
+			require.NoError(t, err)
+			rowID := h.IntValue()
+			require.Equal(t, rowID&((1<<60)-1), i)
+			if deterministic {
+				require.Equal(t, lkv.ShardRowID(456, i, 3), rowID)
+			} else {
+				// the default sharding must stay the same across versions.
+				shard := rand.New(rand.NewSource(i)).Uint32() & 7 // nolint:gosec
+				require.Equal(t, int64(shard)<<60|i, rowID)
+			}
+			keyMap[rowID>>60] = struct{}{}
+		}
+		require.Len(t, keyMap, 8)
+		require.Equal(t, tbl.Allocators(lkv.GetSession4test(encoder).GetTableCtx()).Get(autoid.RowIDAllocType).Base(), int64(32))
 	}
-	require.Len(t, keyMap, 8)
-	require.Equal(t, tbl.Allocators(lkv.GetSession4test(encoder).GetTableCtx()).Get(autoid.RowIDAllocType).Base(), int64(32))
 }
 
 func TestClassifyAndAppend(t *testing.T) {
@@ -612,9 +1182,88 @@ func TestClassifyAndAppend(t *testing.T) {
 	require.Equal(t, indexChecksum.SumKVS(), uint64(1))
 }
 
+func TestClassifyAndAppendEncodedRow(t *testing.T) {
+	for _, createSQL := range []string{
+		// int handle
+		"create table t (a int primary key, b int, key idx_b(b));",
+		// common handle
+		"create table t (a varchar(16) primary key clustered, b int, key idx_b(b));",
+		// _tidb_rowid handle
+		"create table t (a varchar(16) primary key nonclustered, b int, key idx_b(b));",
+	} {
+		tblInfo := mockTableInfo(t, createSQL)
+		tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+		require.NoError(t, err)
+		encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+			Table: tbl,
+			SessionOptions: encode.SessionOptions{
+				SQLMode: mysql.ModeStrictAllTables,
+			},
+			Logger: log.L(),
+		}, nil)
+		require.NoError(t, err)
+		row, err := encoder.Encode([]types.Datum{types.NewStringDatum("1"), types.NewIntDatum(2)}, 1, []int{0, 1, -1}, 0)
+		require.NoError(t, err)
+
+		data := lkv.MakeRowsFromKvPairs(nil)
+		indices := lkv.MakeRowsFromKvPairs(nil)
+		dataChecksum := verification.MakeKVChecksum(0, 0, 0)
+		indexChecksum := verification.MakeKVChecksum(0, 0, 0)
+		row.ClassifyAndAppend(&data, &dataChecksum, &indices, &indexChecksum)
+
+		dataPairs := lkv.Rows2KvPairs(data)
+		require.Len(t, dataPairs, 1, createSQL)
+		require.True(t, tablecodec.IsRecordKey(dataPairs[0].Key), createSQL)
+		indexPairs := lkv.Rows2KvPairs(indices)
+		expectedIndexCnt := 1
+		if !tblInfo.HasClusteredIndex() {
+			// the nonclustered primary key is an index too.
+			expectedIndexCnt = len(tblInfo.Indices)
+		}
+		require.Len(t, indexPairs, expectedIndexCnt, createSQL)
+		for _, pair := range indexPairs {
+			require.True(t, tablecodec.IsIndexKey(pair.Key), createSQL)
+		}
+	}
+}
+
+func TestChecksumContribution(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (a int primary key, b varchar(16), key idx_b(b));")
+	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+	require.NoError(t, err)
+	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+		Table: tbl,
+		SessionOptions: encode.SessionOptions{
+			SQLMode:   mysql.ModeStrictAllTables,
+			Timestamp: 1234567890,
+		},
+		Logger: log.L(),
+	}, nil)
+	require.NoError(t, err)
+
+	running := verification.MakeKVChecksum(0, 0, 0)
+	data := lkv.MakeRowsFromKvPairs(nil)
+	indices := lkv.MakeRowsFromKvPairs(nil)
+	dataChecksum := verification.MakeKVChecksum(0, 0, 0)
+	indexChecksum := verification.MakeKVChecksum(0, 0, 0)
+	for i := 1; i <= 3; i++ {
+		row, err := encoder.Encode([]types.Datum{types.NewIntDatum(int64(i)), types.NewStringDatum(fmt.Sprintf("v%d", i))}, int64(i), []int{0, 1, -1}, 0)
+		require.NoError(t, err)
+		contribution := row.(*lkv.Pairs).ChecksumContribution()
+		require.Equal(t, uint64(2), contribution.SumKVS())
+		require.Equal(t, row.Size(), contribution.SumSize())
+		running.Add(&contribution)
+		row.ClassifyAndAppend(&data, &dataChecksum, &indices, &indexChecksum)
+	}
+
+	dataChecksum.Add(&indexChecksum)
+	require.Equal(t, dataChecksum, running)
+}
+
 type benchSQL2KVSuite struct {
 	row     []types.Datum
 	colPerm []int
+	config  *encode.EncodingConfig
 	encoder encode.Encoder
 	logger  log.Logger
 }
@@ -657,13 +1306,14 @@ func SetUpTest(b *testing.B) *benchSQL2KVSuite {
 	// Construct the corresponding KV encoder.
 	tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tableInfo.SepAutoInc(), 0), tableInfo)
 	require.NoError(b, err)
-	encoder, err := lkv.NewTableKVEncoder(&encode.EncodingConfig{
+	config := &encode.EncodingConfig{
 		Table: tbl,
 		SessionOptions: encode.SessionOptions{
 			SysVars: map[string]string{"tidb_row_format_version": "2"},
 		},
 		Logger: log.L(),
-	}, nil)
+	}
+	encoder, err := lkv.NewTableKVEncoder(config, nil)
 	require.NoError(b, err)
 	logger := log.Logger{Logger: zap.NewNop()}
 
@@ -693,6 +1343,7 @@ func SetUpTest(b *testing.B) *benchSQL2KVSuite {
 	}
 	colPerm := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, -1}
 	s := &benchSQL2KVSuite{
+		config:  config,
 		encoder: encoder,
 		logger:  logger,
 		row:     row,
@@ -711,3 +1362,32 @@ func BenchmarkSQL2KV(b *testing.B) {
 		require.Equal(b, l, 2)
 	}
 }
+
+// BenchmarkSQL2KVWithBufferPool compares the allocations of encoders with and
+// without a shared BufferPool, each encoder encodes 1000 rows before it's
+// closed. Run `go test -benchmem -run=^$ -bench ^BenchmarkSQL2KVWithBufferPool$ -benchtime=1000x github.com/pingcap/tidb/pkg/lightning/backend/kv`
+// to encode a million rows.
+func BenchmarkSQL2KVWithBufferPool(b *testing.B) {
+	s := SetUpTest(b)
+	const rowsPerEncoder = 1000
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pooled=%t", pooled), func(b *testing.B) {
+			var pool *lkv.BufferPool
+			if pooled {
+				pool = lkv.NewBufferPool()
+				defer pool.Destroy()
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encoder, err := lkv.NewTableKVEncoderWithBufferPool(s.config, nil, pool)
+				require.NoError(b, err)
+				for j := 0; j < rowsPerEncoder; j++ {
+					rows, err := encoder.Encode(s.row, int64(j+1), s.colPerm, 0)
+					require.NoError(b, err)
+					lkv.ClearRow(rows)
+				}
+				encoder.Close()
+			}
+		})
+	}
+}
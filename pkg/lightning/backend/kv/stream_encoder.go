@@ -0,0 +1,110 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/lightning/backend/encode"
+	"github.com/pingcap/tidb/pkg/lightning/metric"
+	"github.com/pingcap/tidb/pkg/types"
+)
+
+// KVSink receives the KV pairs generated by StreamingTableKVEncoder.
+type KVSink interface {
+	// Write writes a KV pair. The key and value are only valid during the
+	// call, the implementation must copy them if they are retained.
+	Write(key, val []byte) error
+}
+
+// StreamingTableKVEncoder encodes rows in the same way as the encoder created
+// by NewTableKVEncoder, but each KV pair is written into a KVSink as soon as
+// it is generated, instead of being collected into a Pairs.
+//
+// Memory trade-offs compared to the normal encoder:
+//   - the KV pairs of a row are never held together, so the memory needed by
+//     very wide rows is bounded by the largest single KV pair.
+//   - the sink is called once per KV pair, batching is left to the sink.
+//   - the pairs have no RowID, so it can't be used when duplicate detection
+//     needs the row ID of the pairs.
+//   - if a row fails halfway, the KV pairs generated before the failure have
+//     already been written into the sink.
+type StreamingTableKVEncoder struct {
+	kvcodec *tableKVEncoder
+}
+
+// NewStreamingTableKVEncoder creates a new StreamingTableKVEncoder which writes
+// into sink.
+func NewStreamingTableKVEncoder(
+	config *encode.EncodingConfig,
+	metrics *metric.Metrics,
+	sink KVSink,
+) (*StreamingTableKVEncoder, error) {
+	encoder, err := NewTableKVEncoder(config, metrics)
+	if err != nil {
+		return nil, err
+	}
+	kvcodec := encoder.(*tableKVEncoder)
+	kvcodec.SessionCtx.txn.MemBuf.sink = sink
+	return &StreamingTableKVEncoder{kvcodec: kvcodec}, nil
+}
+
+// Encode encodes a row of data and writes the KV pairs into the sink.
+//
+// See comments in `(*TableRestore).initializeColumns` for the meaning of the
+// `columnPermutation` parameter.
+func (e *StreamingTableKVEncoder) Encode(row []types.Datum, rowID int64, columnPermutation []int) error {
+	defer e.kvcodec.TruncateWarns()
+
+	_, rowValue, _, err := e.kvcodec.encodeRow(row, rowID, columnPermutation, nil)
+	if err != nil {
+		return err
+	}
+	return e.kvcodec.rebaseRowID(rowValue)
+}
+
+// Close closes the encoder.
+func (e *StreamingTableKVEncoder) Close() {
+	e.kvcodec.Close()
+}
+
+type writerSink struct {
+	w      io.Writer
+	lenBuf [16]byte
+}
+
+// NewWriterSink returns a KVSink which writes the KV pairs into w, each KV pair
+// is written as <key length><value length><key><value>, the lengths are 8-byte
+// big endian, which is the same layout as the data files of the external
+// backend.
+func NewWriterSink(w io.Writer) KVSink {
+	return &writerSink{w: w}
+}
+
+// Write implements the KVSink interface.
+func (s *writerSink) Write(key, val []byte) error {
+	binary.BigEndian.PutUint64(s.lenBuf[:8], uint64(len(key)))
+	binary.BigEndian.PutUint64(s.lenBuf[8:], uint64(len(val)))
+	if _, err := s.w.Write(s.lenBuf[:]); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := s.w.Write(key); err != nil {
+		return errors.Trace(err)
+	}
+	_, err := s.w.Write(val)
+	return errors.Trace(err)
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pingcap/tidb/pkg/lightning/backend/encode"
+	lkv "github.com/pingcap/tidb/pkg/lightning/backend/kv"
+	"github.com/pingcap/tidb/pkg/lightning/common"
+	"github.com/pingcap/tidb/pkg/lightning/log"
+	"github.com/pingcap/tidb/pkg/meta/autoid"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/table/tables"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeWriterSink(t *testing.T, data []byte) []common.KvPair {
+	var pairs []common.KvPair
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 16)
+		keyLen := binary.BigEndian.Uint64(data)
+		valLen := binary.BigEndian.Uint64(data[8:])
+		data = data[16:]
+		pairs = append(pairs, common.KvPair{
+			Key: data[:keyLen],
+			Val: data[keyLen : keyLen+valLen],
+		})
+		data = data[keyLen+valLen:]
+	}
+	return pairs
+}
+
+func TestStreamingTableKVEncoder(t *testing.T) {
+	tblInfo := mockTableInfo(t, "create table t (a int, b varchar(16), c json, key idx_b(b));")
+	config := func() *encode.EncodingConfig {
+		tbl, err := tables.TableFromMeta(lkv.NewPanickingAllocators(tblInfo.SepAutoInc(), 0), tblInfo)
+		require.NoError(t, err)
+		return &encode.EncodingConfig{
+			Table: tbl,
+			SessionOptions: encode.SessionOptions{
+				SQLMode:   mysql.ModeStrictAllTables,
+				Timestamp: 1234567890,
+			},
+			Logger: log.L(),
+		}
+	}
+
+	rows := [][]types.Datum{
+		{types.NewIntDatum(1), types.NewStringDatum("x"), types.NewStringDatum(`{"k": 1}`)},
+		{types.NewIntDatum(2), types.NewStringDatum("y"), types.NewStringDatum(`[1, 2, 3]`)},
+	}
+	colPerm := []int{0, 1, 2, -1}
+
+	encoder, err := lkv.NewTableKVEncoder(config(), nil)
+	require.NoError(t, err)
+	defer encoder.Close()
+	var expected []common.KvPair
+	for i, row := range rows {
+		pairs, err := encoder.Encode(row, int64(i+1), colPerm, 0)
+		require.NoError(t, err)
+		for _, pair := range lkv.Row2KvPairs(pairs) {
+			expected = append(expected, common.KvPair{Key: pair.Key, Val: pair.Val})
+		}
+	}
+
+	var buf bytes.Buffer
+	streamConfig := config()
+	streamEncoder, err := lkv.NewStreamingTableKVEncoder(streamConfig, nil, lkv.NewWriterSink(&buf))
+	require.NoError(t, err)
+	defer streamEncoder.Close()
+	for i, row := range rows {
+		require.NoError(t, streamEncoder.Encode(row, int64(i+1), colPerm))
+	}
+	require.Equal(t, expected, decodeWriterSink(t, buf.Bytes()))
+
+	alloc := streamConfig.Table.Allocators(nil).Get(autoid.RowIDAllocType)
+	require.Equal(t, int64(2), alloc.Base())
+
+	// bad values are reported like the normal encoder.
+	err = streamEncoder.Encode([]types.Datum{types.NewStringDatum("bad"), types.NewStringDatum("z"), types.NewStringDatum("{}")}, 3, colPerm)
+	require.ErrorContains(t, err, "for column `a` (#1)")
+}
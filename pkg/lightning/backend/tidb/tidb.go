@@ -92,8 +92,9 @@ type tidbEncoder struct {
 	// the there are enough columns.
 	columnCnt int
 	// data file path
-	path   string
-	logger log.Logger
+	path             string
+	logger           log.Logger
+	collectRowErrors bool
 }
 
 type encodingBuilder struct{}
@@ -113,11 +114,12 @@ func (*encodingBuilder) NewEncoder(ctx context.Context, config *encode.EncodingC
 	}
 
 	return &tidbEncoder{
-		mode:   config.SQLMode,
-		tbl:    config.Table,
-		se:     se,
-		path:   config.Path,
-		logger: config.Logger,
+		mode:             config.SQLMode,
+		tbl:              config.Table,
+		se:               se,
+		path:             config.Path,
+		logger:           config.Logger,
+		collectRowErrors: config.CollectRowErrors,
 	}, nil
 }
 
@@ -525,6 +527,14 @@ func getColumnByIndex(cols []*table.Column, index int) *table.Column {
 }
 
 func (enc *tidbEncoder) Encode(row []types.Datum, _ int64, columnPermutation []int, offset int64) (encode.Row, error) {
+	encoded, _, err := enc.encodeRow(row, columnPermutation, offset)
+	return encoded, err
+}
+
+// encodeRow encodes a row into an INSERT value list. If the error is caused by
+// a value of the row which can't be converted, badColumn is the name of the
+// column of the value.
+func (enc *tidbEncoder) encodeRow(row []types.Datum, columnPermutation []int, offset int64) (_ encode.Row, badColumn string, err error) {
 	cols := enc.tbl.Cols()
 
 	if len(enc.columnIdx) == 0 {
@@ -553,7 +563,7 @@ func (enc *tidbEncoder) Encode(row []types.Datum, _ int64, columnPermutation []i
 		// there are enc.columnCnt elements to insert but fewer columns in row
 		enc.logger.Error("column count mismatch", zap.Ints("column_permutation", columnPermutation),
 			zap.Array("data", kv.RowArrayMarshaller(row)))
-		return emptyTiDBRow, errors.Errorf("column count mismatch, expected %d, got %d", enc.columnCnt, len(row))
+		return emptyTiDBRow, "", errors.Errorf("column count mismatch, expected %d, got %d", enc.columnCnt, len(row))
 	}
 
 	if len(row) > len(enc.columnIdx) {
@@ -561,7 +571,7 @@ func (enc *tidbEncoder) Encode(row []types.Datum, _ int64, columnPermutation []i
 		// in the table
 		enc.logger.Error("column count mismatch", zap.Ints("column_count", enc.columnIdx),
 			zap.Array("data", kv.RowArrayMarshaller(row)))
-		return emptyTiDBRow, errors.Errorf("column count mismatch, at most %d but got %d", len(enc.columnIdx), len(row))
+		return emptyTiDBRow, "", errors.Errorf("column count mismatch, at most %d but got %d", len(enc.columnIdx), len(row))
 	}
 
 	var encoded strings.Builder
@@ -576,13 +586,14 @@ func (enc *tidbEncoder) Encode(row []types.Datum, _ int64, columnPermutation []i
 			encoded.WriteByte(',')
 		}
 		datum := field
-		if err := enc.appendSQL(&encoded, &datum, getColumnByIndex(cols, enc.columnIdx[i])); err != nil {
+		col := getColumnByIndex(cols, enc.columnIdx[i])
+		if err := enc.appendSQL(&encoded, &datum, col); err != nil {
 			enc.logger.Error("tidb encode failed",
 				zap.Array("original", kv.RowArrayMarshaller(row)),
 				zap.Int("originalCol", i),
 				log.ShortError(err),
 			)
-			return nil, err
+			return nil, col.Name.O, err
 		}
 		cnt++
 	}
@@ -591,7 +602,36 @@ func (enc *tidbEncoder) Encode(row []types.Datum, _ int64, columnPermutation []i
 		insertStmt: encoded.String(),
 		path:       enc.path,
 		offset:     offset,
-	}, nil
+	}, "", nil
+}
+
+// EncodeBatch implements the encode.Encoder interface. When collectRowErrors
+// is set, the rows with bad values are skipped and their errors are returned
+// as an encode.RowErrors, other errors still fail the whole batch.
+func (enc *tidbEncoder) EncodeBatch(rows [][]types.Datum, firstRowID int64, columnPermutation []int, offsets []int64) ([]encode.Row, error) {
+	if len(offsets) != len(rows) {
+		return nil, errors.Errorf("EncodeBatch got %d offsets for %d rows", len(offsets), len(rows))
+	}
+	result := make([]encode.Row, 0, len(rows))
+	var rowErrs encode.RowErrors
+	for i, row := range rows {
+		rowID := firstRowID + int64(i)
+		encoded, badColumn, err := enc.encodeRow(row, columnPermutation, offsets[i])
+		if err != nil {
+			if badColumn != "" && enc.collectRowErrors {
+				rowErrs = append(rowErrs, encode.RowError{
+					Index: i, RowID: rowID, Offset: offsets[i], Column: badColumn, Err: err,
+				})
+				continue
+			}
+			return nil, err
+		}
+		result = append(result, encoded)
+	}
+	if len(rowErrs) > 0 {
+		return result, rowErrs
+	}
+	return result, nil
 }
 
 // EncodeRowForRecord encodes a row to a string compatible with INSERT statements.
@@ -858,6 +858,44 @@ func TestEncodeRowForRecord(t *testing.T) {
 	require.Equal(t, row, "(5, \"test test\", \x00\x00\x00\xab\xcd\xef)")
 }
 
+func TestEncodeBatchCollectRowErrors(t *testing.T) {
+	s := createMysqlSuite(t)
+	encoder, err := s.encBuilder.NewEncoder(context.Background(), &encode.EncodingConfig{
+		Path:             "1.csv",
+		Table:            s.tbl,
+		Logger:           log.L(),
+		CollectRowErrors: true,
+	})
+	require.NoError(t, err)
+	colPerm := []int{0, -1, -1, -1, -1, -1, -1, -1, -1, -1, 1, -1, -1, -1}
+	rows := [][]types.Datum{
+		{types.NewIntDatum(1), types.NewMysqlBitDatum(types.NewBinaryLiteralFromUint(1, -1))},
+		// the bit value is too long to be converted.
+		{types.NewIntDatum(2), types.NewMysqlBitDatum(types.BinaryLiteral{1, 2, 3, 4, 5, 6, 7, 8, 9})},
+		{types.NewIntDatum(3), types.NewMysqlBitDatum(types.NewBinaryLiteralFromUint(3, -1))},
+	}
+	encoded, err := encoder.EncodeBatch(rows, 1, colPerm, []int64{10, 20, 30})
+	require.Len(t, encoded, 2)
+	var rowErrs encode.RowErrors
+	require.ErrorAs(t, err, &rowErrs)
+	require.Len(t, rowErrs, 1)
+	require.Equal(t, 1, rowErrs[0].Index)
+	require.Equal(t, int64(2), rowErrs[0].RowID)
+	require.Equal(t, int64(20), rowErrs[0].Offset)
+	require.Equal(t, "c10", rowErrs[0].Column)
+
+	// the errors not caused by a bad value still fail the whole batch.
+	badRow := make([]types.Datum, 0, 15)
+	for i := 0; i < 15; i++ {
+		badRow = append(badRow, types.NewIntDatum(0))
+	}
+	encoded, err = encoder.EncodeBatch(append(rows[:1:1], badRow), 1, colPerm, []int64{10, 20})
+	require.ErrorContains(t, err, "column count mismatch, at most")
+	_, ok := err.(encode.RowErrors)
+	require.False(t, ok)
+	require.Nil(t, encoded)
+}
+
 // TestLogicalImportBatch tests that each INSERT statement is limited by both
 // logical-import-batch-size and logical-import-batch-rows configurations. Here
 // we ensure each INSERT statement has up to 5 rows *and* ~30 bytes of values.
@@ -54,6 +54,9 @@ const (
 	BlockDeliverKindIndex = "index"
 	BlockDeliverKindData  = "data"
 
+	EncodeStepEvalGenCols = "eval_generated_columns" // for the KvEncodeStepSecondsHistogram labels, below too
+	EncodeStepAddRecord   = "add_record"
+
 	lightningNamespace = "lightning"
 )
 
@@ -80,6 +83,9 @@ type Common struct {
 	BlockDeliverSecondsHistogram prometheus.Histogram
 	BlockDeliverBytesHistogram   *prometheus.HistogramVec
 	BlockDeliverKVPairsHistogram *prometheus.HistogramVec
+	// KvConvertFailedCounter counts the values failed to convert to KV, by
+	// the type of the target column.
+	KvConvertFailedCounter *prometheus.CounterVec
 }
 
 // NewCommon returns common metrics instance.
@@ -165,6 +171,14 @@ func NewCommon(factory promutil.Factory, namespace, subsystem string, constLabel
 				ConstLabels: constLabels,
 				Buckets:     prometheus.ExponentialBuckets(1, 2, 10),
 			}, []string{"kind"}),
+		KvConvertFailedCounter: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   subsystem,
+				Name:        "kv_convert_failed",
+				Help:        "count number of values failed to convert to kv, by target column type",
+				ConstLabels: constLabels,
+			}, []string{"type"}),
 	}
 }
 
@@ -179,6 +193,7 @@ func (c *Common) RegisterTo(r promutil.Registry) {
 		c.BlockDeliverSecondsHistogram,
 		c.BlockDeliverBytesHistogram,
 		c.BlockDeliverKVPairsHistogram,
+		c.KvConvertFailedCounter,
 	)
 }
 
@@ -192,6 +207,7 @@ func (c *Common) UnregisterFrom(r promutil.Registry) {
 	r.Unregister(c.BlockDeliverSecondsHistogram)
 	r.Unregister(c.BlockDeliverBytesHistogram)
 	r.Unregister(c.BlockDeliverKVPairsHistogram)
+	r.Unregister(c.KvConvertFailedCounter)
 }
 
 // Metrics contains all metrics used by lightning.
@@ -205,6 +221,7 @@ type Metrics struct {
 	ChunkParserReadBlockSecondsHistogram prometheus.Histogram
 	ApplyWorkerSecondsHistogram          *prometheus.HistogramVec
 	RowKVDeliverSecondsHistogram         prometheus.Histogram
+	KvEncodeStepSecondsHistogram         *prometheus.HistogramVec
 	// RowReadBytesHistogram records the number of bytes read from data source
 	// for a batch of rows.
 	// it's a little duplicate with RowsCounter of state = "restored".
@@ -287,6 +304,14 @@ func NewMetrics(factory promutil.Factory) *Metrics {
 				Buckets:   prometheus.ExponentialBuckets(0.001, 3.1622776601683795, 10),
 			}),
 
+		KvEncodeStepSecondsHistogram: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: lightningNamespace,
+				Name:      "kv_encode_step_seconds",
+				Help:      "time needed by each step of encoding a row into kv",
+				Buckets:   prometheus.ExponentialBuckets(0.00001, 3.1622776601683795, 10),
+			}, []string{"step"}),
+
 		RowReadBytesHistogram: factory.NewHistogram(
 			prometheus.HistogramOpts{
 				Namespace: lightningNamespace,
@@ -338,6 +363,7 @@ func (m *Metrics) RegisterTo(r promutil.Registry) {
 		m.ChunkParserReadBlockSecondsHistogram,
 		m.ApplyWorkerSecondsHistogram,
 		m.RowKVDeliverSecondsHistogram,
+		m.KvEncodeStepSecondsHistogram,
 		m.RowReadBytesHistogram,
 		m.ChecksumSecondsHistogram,
 		m.SSTSecondsHistogram,
@@ -358,6 +384,7 @@ func (m *Metrics) UnregisterFrom(r promutil.Registry) {
 	r.Unregister(m.ChunkParserReadBlockSecondsHistogram)
 	r.Unregister(m.ApplyWorkerSecondsHistogram)
 	r.Unregister(m.RowKVDeliverSecondsHistogram)
+	r.Unregister(m.KvEncodeStepSecondsHistogram)
 	r.Unregister(m.RowReadBytesHistogram)
 	r.Unregister(m.ChecksumSecondsHistogram)
 	r.Unregister(m.SSTSecondsHistogram)
@@ -1025,6 +1025,50 @@ func TestAllHistory(t *testing.T) {
 	require.NoError(t, resp.Body.Close())
 }
 
+func TestDDLDeleteRange(t *testing.T) {
+	ts := createBasicHTTPHandlerTestSuite()
+	ts.startServer(t)
+	ts.prepareData(t)
+	defer ts.stopServer(t)
+
+	// all the delete ranges of the history jobs are as expected.
+	resp, err := ts.FetchStatus("/ddl/delete_range")
+	require.NoError(t, err)
+	var reports []tikvhandler.DeleteRangeReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reports))
+	require.NoError(t, resp.Body.Close())
+	require.Empty(t, reports)
+
+	resp, err = ts.FetchStatus("/ddl/history")
+	require.NoError(t, err)
+	var jobs []*model.Job
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	require.NoError(t, resp.Body.Close())
+	var jobID int64
+	for _, job := range jobs {
+		if job.Type == model.ActionDropIndex {
+			jobID = job.ID
+		}
+	}
+	require.NotZero(t, jobID)
+	resp, err = ts.FetchStatus(fmt.Sprintf("/ddl/delete_range?job_id=%d", jobID))
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reports))
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, []tikvhandler.DeleteRangeReport{
+		{JobID: jobID, JobType: model.ActionDropIndex.String(), Expected: 1, Actual: 1},
+	}, reports)
+
+	resp, err = ts.FetchStatus("/ddl/delete_range?job_id=0")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	resp, err = ts.FetchStatus("/ddl/delete_range?start_ts=2&end_ts=1")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
+
 func filterSpaces(bs []byte) []byte {
 	if len(bs) == 0 {
 		return nil
@@ -154,6 +154,17 @@ func NewDDLHistoryJobHandler(tool *handler.TikvHandlerTool) *DDLHistoryJobHandle
 	return &DDLHistoryJobHandler{tool}
 }
 
+// DDLDeleteRangeHandler is the handler for reconciling the delete ranges of
+// history DDL jobs.
+type DDLDeleteRangeHandler struct {
+	*handler.TikvHandlerTool
+}
+
+// NewDDLDeleteRangeHandler creates a new DDLDeleteRangeHandler.
+func NewDDLDeleteRangeHandler(tool *handler.TikvHandlerTool) *DDLDeleteRangeHandler {
+	return &DDLDeleteRangeHandler{tool}
+}
+
 // DDLResignOwnerHandler is the handler for resigning ddl owner.
 type DDLResignOwnerHandler struct {
 	store kv.Storage
@@ -1122,6 +1133,93 @@ func (h DDLHistoryJobHandler) getHistoryDDL(jobID, limit int) (jobs []*model.Job
 	return jobs, nil
 }
 
+// DeleteRangeReport is the result of reconciling the delete ranges of a
+// history DDL job, see ddl.DeleteRangeReport.
+type DeleteRangeReport struct {
+	JobID    int64  `json:"job_id"`
+	JobType  string `json:"job_type"`
+	Expected int    `json:"expected"`
+	Actual   int    `json:"actual"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ServeHTTP handles request of reconciling the delete ranges of history DDL
+// jobs. The job specified by job_id is always reported, otherwise the jobs
+// finished between start_ts and end_ts are reconciled and only the mismatched
+// ones are reported.
+func (h DDLDeleteRangeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var jobID int64
+	startTS, endTS := uint64(0), uint64(math.MaxUint64)
+	var err error
+	if jobValue := req.FormValue(handler.JobIDQuery); len(jobValue) > 0 {
+		jobID, err = strconv.ParseInt(jobValue, 10, 64)
+		if err != nil {
+			handler.WriteError(w, err)
+			return
+		}
+		if jobID < 1 {
+			handler.WriteError(w, errors.New("ddl delete range job_id must be greater than 0"))
+			return
+		}
+	}
+	if tsValue := req.FormValue(handler.StartTSQuery); len(tsValue) > 0 {
+		startTS, err = strconv.ParseUint(tsValue, 10, 64)
+		if err != nil {
+			handler.WriteError(w, err)
+			return
+		}
+	}
+	if tsValue := req.FormValue(handler.EndTSQuery); len(tsValue) > 0 {
+		endTS, err = strconv.ParseUint(tsValue, 10, 64)
+		if err != nil {
+			handler.WriteError(w, err)
+			return
+		}
+	}
+	if startTS > endTS {
+		handler.WriteError(w, errors.New("ddl delete range start_ts must not be greater than end_ts"))
+		return
+	}
+
+	reports, err := h.reconcileDeleteRanges(jobID, startTS, endTS)
+	if err != nil {
+		handler.WriteError(w, err)
+		return
+	}
+	handler.WriteData(w, reports)
+}
+
+func (h DDLDeleteRangeHandler) reconcileDeleteRanges(jobID int64, startTS, endTS uint64) ([]DeleteRangeReport, error) {
+	s, err := session.CreateSession(h.Store)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer s.Close()
+
+	var reports []*ddl.DeleteRangeReport
+	if jobID > 0 {
+		report, err := ddl.ReconcileDeleteRangeCnt(s.GetStore(), s.GetSQLExecutor(), jobID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		reports = append(reports, report)
+	} else {
+		reports, err = ddl.ReconcileDeleteRangeCntInRange(s.GetStore(), s.GetSQLExecutor(), startTS, endTS)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	result := make([]DeleteRangeReport, 0, len(reports))
+	for _, r := range reports {
+		report := DeleteRangeReport{JobID: r.JobID, JobType: r.JobType.String(), Expected: r.Expected, Actual: r.Actual}
+		if r.Err != nil {
+			report.Error = r.Err.Error()
+		}
+		result = append(result, report)
+	}
+	return result, nil
+}
+
 func (h DDLResignOwnerHandler) resignDDLOwner() error {
 	dom, err := session.GetDomain(h.store)
 	if err != nil {
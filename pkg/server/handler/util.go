@@ -62,6 +62,9 @@ const (
 	JobID        = "start_job_id"
 	Operation    = "op"
 	Seconds      = "seconds"
+	JobIDQuery   = "job_id"
+	StartTSQuery = "start_ts"
+	EndTSQuery   = "end_ts"
 )
 
 const (
@@ -236,6 +236,7 @@ func (s *Server) startHTTPServer() {
 	router.Handle("/schema_storage/{db}/{table}", tikvhandler.NewSchemaStorageHandler(tikvHandlerTool))
 
 	router.Handle("/ddl/history", tikvhandler.NewDDLHistoryJobHandler(tikvHandlerTool)).Name("DDL_History")
+	router.Handle("/ddl/delete_range", tikvhandler.NewDDLDeleteRangeHandler(tikvHandlerTool)).Name("DDL_Delete_Range")
 	router.Handle("/ddl/owner/resign", tikvhandler.NewDDLResignOwnerHandler(tikvHandlerTool.Store.(kv.Storage))).Name("DDL_Owner_Resign")
 
 	// HTTP path for get the TiDB config